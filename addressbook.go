@@ -0,0 +1,140 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/laochailan/barely/completion"
+	"github.com/laochailan/notmuch-go"
+)
+
+// addressCommands are the prompt commands whose arguments are completed as
+// mail addresses.
+var addressCommands = map[string]bool{
+	"to":     true,
+	"cc":     true,
+	"bcc":    true,
+	"bounce": true,
+}
+
+// addressBookMaxAge is the time after which the address book is loaded again.
+const addressBookMaxAge = 10 * time.Minute
+
+// addressBookLoading is shown while the address book is loaded for the first time.
+const addressBookLoading = "Loading address book..."
+
+// addressBook caches the addresses used for completion. It is only accessed
+// from the main loop; loading happens in the background.
+var addressBook struct {
+	book     *completion.AddressBook
+	loadTime time.Time
+	loading  bool
+}
+
+// loadAddressBook collects the senders of all messages and the recipients of
+// mail sent from one of the accounts out of the notmuch database. The contacts
+// in the configured address-book files are added as well.
+func loadAddressBook() (*completion.AddressBook, error) {
+	book := completion.NewAddressBook()
+
+	db, status := notmuch.OpenDatabase(expandEnvHome(config.General.Database), 0)
+	if status != notmuch.STATUS_SUCCESS {
+		return book, errors.New(status.String())
+	}
+	defer db.Close()
+
+	addAddresses := func(queryStr string, keys ...string) {
+		query := db.CreateQuery(queryStr)
+		defer query.Destroy()
+		msgs := query.SearchMessages()
+		if msgs == nil {
+			return
+		}
+		for ; msgs.Valid(); msgs.MoveToNext() {
+			msg := msgs.Get()
+			for _, key := range keys {
+				list, err := mail.ParseAddressList(msg.GetHeader(key))
+				if err != nil {
+					continue
+				}
+				for _, addr := range list {
+					if !isOwnAddress(addr.Address) {
+						book.Add(addr.Name, addr.Address)
+					}
+				}
+			}
+			msg.Destroy()
+		}
+	}
+
+	addAddresses("*", "From")
+	var sent []string
+	for _, account := range config.Account {
+		sent = append(sent, "from:"+account.Addr)
+	}
+	if len(sent) > 0 {
+		addAddresses(strings.Join(sent, " OR "), "To", "Cc")
+	}
+
+	for _, filename := range config.General.Address_Book {
+		if err := readAddressBookFile(book, expandEnvHome(filename)); err != nil {
+			return book, err
+		}
+	}
+	return book, nil
+}
+
+// readAddressBookFile adds the contacts in filename to book. Files ending in
+// .vcf or .vcard are read as vCard, all others as abook addressbook.
+func readAddressBookFile(book *completion.AddressBook, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".vcf", ".vcard":
+		return book.ReadVCard(file)
+	}
+	return book.ReadAbook(file)
+}
+
+// currentAddressBook returns the cached address book. If there is none yet
+// or it is older than addressBookMaxAge, it is loaded in the background and
+// the old, possibly empty, book is returned in the meantime.
+func currentAddressBook() *completion.AddressBook {
+	if addressBook.book == nil {
+		addressBook.book = completion.NewAddressBook()
+	}
+	if !addressBook.loading && (addressBook.loadTime.IsZero() ||
+		time.Since(addressBook.loadTime) > addressBookMaxAge) {
+		addressBook.loading = true
+		var book *completion.AddressBook
+		runAsync(func() (err error) {
+			book, err = loadAddressBook()
+			return err
+		}, func(stack *BufferStack, err error) {
+			addressBook.loading = false
+			addressBook.book, addressBook.loadTime = book, time.Now()
+			if err != nil {
+				StatusLine = "Could not load address book: " + err.Error()
+				stack.refresh()
+			} else if StatusLine == addressBookLoading {
+				StatusLine = ""
+			}
+		})
+	}
+	if addressBook.loadTime.IsZero() {
+		StatusLine = addressBookLoading
+	}
+	return addressBook.book
+}
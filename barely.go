@@ -32,21 +32,92 @@ const (
 
 var logbuf bytes.Buffer
 
-// redirect panics to stdout
-func recoverPanic() {
-	if r := recover(); r != nil {
-		termbox.Close()
-		fmt.Println(r)
-		buf := make([]byte, 2048)
-		l := runtime.Stack(buf, true)
-		fmt.Println(string(buf[:l]))
+// saveUnsentMail tries to save all unsent mail after a crash. Mail is saved as draft
+// if possible. Otherwise it is written to a file in the temporary directory.
+func saveUnsentMail() {
+	composeBuffers.Lock()
+	buffers := make([]*ComposeBuffer, 0, len(composeBuffers.buffers))
+	for b := range composeBuffers.buffers {
+		buffers = append(buffers, b)
+	}
+	composeBuffers.Unlock()
+
+	i := 0
+	for _, b := range buffers {
+		if !b.unsaved() {
+			continue
+		}
+		err := b.saveDraft()
+		if err == nil {
+			fmt.Println("Saved unsent mail as draft " + b.draftFile)
+			continue
+		}
+
+		i++
+		filename := os.TempDir() + fmt.Sprintf("/barely-unsent-%d-%d.eml", os.Getpid(), i)
+		err = writeEditString(filename, b.mb.mail)
+		if err != nil {
+			fmt.Println("Could not save unsent mail: " + err.Error())
+		} else {
+			fmt.Println("Saved unsent mail to " + filename)
+		}
 	}
+}
+
+// reportCrash prints the panic value r with a stack trace to stdout and
+// tries to save all unsent mail.
+func reportCrash(r interface{}) {
+	termbox.Close()
+	fmt.Println(r)
+	buf := make([]byte, 2048)
+	l := runtime.Stack(buf, true)
+	fmt.Println(string(buf[:l]))
+	trySaveUnsentMail()
+}
+
+// trySaveUnsentMail saves unsent mail while barely exits because of an error.
+func trySaveUnsentMail() {
+	// saving must not hide the original error
+	defer func() { recover() }()
+	saveUnsentMail()
+}
+
+// fatal is used instead of log.Fatal. Like after a panic, unsent mail is saved
+// before barely exits.
+func fatal(v ...interface{}) {
+	termbox.Close()
+	fmt.Println(v...)
+	trySaveUnsentMail()
+	printLog()
+	os.Exit(1)
+}
+
+// printLog prints the debug log, if there is any.
+func printLog() {
 	if len(logbuf.Bytes()) != 0 {
 		fmt.Println("Debug log:")
 		fmt.Print(logbuf.String())
 	}
 }
 
+// redirect panics to stdout
+func recoverPanic() {
+	if r := recover(); r != nil {
+		reportCrash(r)
+	}
+	printLog()
+}
+
+// exitOnPanic handles panics in goroutines other than the main one. Those
+// are not seen by recoverPanic, so barely has to exit here.
+func exitOnPanic() {
+	if r := recover(); r != nil {
+		reportCrash(r)
+		printLog()
+		os.Exit(2)
+	}
+}
+
 func tmpDir() string {
 	return os.TempDir() + fmt.Sprintf("/barely-%d", os.Getpid())
 }
@@ -55,10 +126,22 @@ func main() {
 	defer recoverPanic()
 
 	showcfg := flag.Bool("config", false, "Print example config file.")
+	addresses := flag.String("addresses", "", "Print known addresses starting with the given text, most used first.")
 	flag.Parse()
 
 	if *showcfg {
-		fmt.Print(DefaultCfg)
+		os.Stdout.WriteString(DefaultCfg)
+		return
+	}
+	if *addresses != "" {
+		LoadConfig()
+		book, err := loadAddressBook()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		for _, addr := range book.Match(*addresses) {
+			fmt.Println(addr.String())
+		}
 		return
 	}
 
@@ -79,19 +162,21 @@ func main() {
 
 	err = termbox.Init()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	termbox.SetOutputMode(termbox.Output256)
+	updateOutboxCount()
 	buffers.Init()
 
-	for len(buffers.buffers) > 0 {
-		err = termbox.Flush()
-		if err != nil {
-			log.Fatal(err)
-		}
-		event := termbox.PollEvent()
-		buffers.HandleEvent(&event)
+	if config.General.Refresh_Interval > 0 {
+		go watchDatabase(expandEnvHome(config.General.Database),
+			time.Duration(config.General.Refresh_Interval)*time.Second)
+	}
+
+	err = runMainLoop(&buffers)
+	if err != nil {
+		fatal(err)
 	}
 	termbox.Close()
 
@@ -6,6 +6,7 @@ package main
 
 import (
 	"fmt"
+	"net/mail"
 	"strings"
 
 	termbox "github.com/nsf/termbox-go"
@@ -27,12 +28,27 @@ type Buffer interface {
 	HandleCommand(cmd string, args []string, stack *BufferStack) bool
 }
 
+// positioner is implemented by buffers that display a list of items. The position
+// of the cursor in that list is shown in the bottom bar.
+type positioner interface {
+	// Position returns the (1-based) cursor position and the total number of items.
+	Position() (cur, total int)
+}
+
 // BufferStack is the Stack structure managing drawing of the screen and
 // buffers.
 type BufferStack struct {
 	buffers []Buffer
 
 	prompt Prompt
+
+	// undo and redo history of tag changes. The last entry is the most recent.
+	undoHistory [][]tagChange
+	redoHistory [][]tagChange
+
+	question *question // question the user has to answer, if any
+	quitting bool      // all buffers are being closed
+	flushing bool      // the outbox is being sent
 }
 
 func invalidCommand(cmd string) {
@@ -72,14 +88,32 @@ func (b *BufferStack) Push(n Buffer) {
 // StatusLine is displayed at the bottom of the screen. useful for error messages.
 var StatusLine string
 
-// Pop pops the last buffer from the stack.
+// Pop closes the last buffer on the stack. Like the close command, it asks
+// first if the buffer contains unsent mail.
 func (b *BufferStack) Pop() {
 	if len(b.buffers) == 0 {
 		return
 	}
-	b.buffers[len(b.buffers)-1].Close()
-	b.buffers = b.buffers[:len(b.buffers)-1]
-	b.refresh()
+	b.closeBuffer(b.buffers[len(b.buffers)-1])
+}
+
+// detach removes buf from the stack without closing it. It returns false if
+// buf is not on the stack.
+func (b *BufferStack) detach(buf Buffer) bool {
+	for i := range b.buffers {
+		if b.buffers[i] == buf {
+			b.buffers = append(b.buffers[:i], b.buffers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// remove closes buf and removes it from the stack.
+func (b *BufferStack) remove(buf Buffer) {
+	if b.detach(buf) {
+		buf.Close()
+	}
 }
 
 // refresh clears the terminal and redraws everything.
@@ -90,51 +124,111 @@ func (b *BufferStack) refresh() {
 	}
 	b.buffers[len(b.buffers)-1].HandleCommand("_refresh", nil, b)
 	b.buffers[len(b.buffers)-1].Draw()
+	b.drawBottomBar()
+	if b.question != nil {
+		_, h := termbox.Size()
+		printLine(0, h-1, b.question.text, config.Theme.Error|int(termbox.AttrBold), -1)
+	} else if b.prompt.Active() {
+		b.prompt.Draw()
+	} else if StatusLine != "" {
+		_, h := termbox.Size()
+		printLine(0, h-1, StatusLine, -1, -1)
+	}
+	termbox.Flush()
+}
+
+// drawBottomBar draws the bar showing the title of the current buffer.
+func (b *BufferStack) drawBottomBar() {
 	w, h := termbox.Size()
 	cbuf := termbox.CellBuffer()
 	for i := 0; i < w; i++ {
+		cbuf[(h-2)*w+i].Ch = 0
 		cbuf[(h-2)*w+i].Bg = termbox.Attribute(config.Theme.BottomBar)
 		cbuf[(h-2)*w+i].Fg = termbox.AttrBold
 	}
-	title := b.buffers[len(b.buffers)-1].Title()
-	name := b.buffers[len(b.buffers)-1].Name()
-	printLine(0, h-2, fmt.Sprintf("[%d: %s] %s", len(b.buffers)-1, name, title), -1, -1)
-	if b.prompt.Active() {
-		b.prompt.Draw()
-	} else if StatusLine != "" {
-		_, h := termbox.Size()
-		printLine(0, h-1, StatusLine, -1, -1)
+	buf := b.buffers[len(b.buffers)-1]
+	printLine(0, h-2, fmt.Sprintf("[%d: %s] %s", len(b.buffers)-1, buf.Name(), buf.Title()), -1, -1)
+
+	right := ""
+	if outboxCount > 0 {
+		right = fmt.Sprintf("[%d queued] ", outboxCount)
 	}
-	termbox.Flush()
+	if p, ok := buf.(positioner); ok {
+		cur, total := p.Position()
+		right += fmt.Sprintf("%d/%d", cur, total)
+	}
+	printLine(w-len(right)-1, h-2, right, -1, -1)
 }
 
 // handleCommand executes global commands.
 func (b *BufferStack) handleCommand(cmd string, args []string) bool {
 	switch cmd {
 	case "close":
-		b.Pop()
-	case "quit":
-		for _, buf := range b.buffers {
-			buf.Close()
+		if len(b.buffers) > 0 {
+			b.closeBuffer(b.buffers[len(b.buffers)-1])
 		}
-		b.buffers = nil
+	case "quit":
+		b.quit()
 	case "search":
 		b.Push(NewSearchBuffer(strings.Join(args, " "), STThreads))
 	case "msearch":
 		b.Push(NewSearchBuffer(strings.Join(args, " "), STMessages))
 	case "compose":
-		b.Push(NewComposeBuffer(composeMail()))
+		m, err := composeNew()
+		if err != nil {
+			StatusLine = err.Error()
+		}
+		b.Push(NewComposeBuffer(m))
 	case "help":
 		b.Push(&HelpBuffer{b.buffers[len(b.buffers)-1].Name()})
 	case "prompt":
 		StatusLine = ""
 		b.prompt.Activate(strings.Join(args, " "))
+	case "flushqueue":
+		if b.flushing {
+			StatusLine = "Outbox is already being sent."
+			break
+		}
+		b.flushing = true
+		StatusLine = "Sending queued mail..."
+		var sent []mail.Header
+		var failed int
+		runAsync(func() (err error) {
+			sent, failed, err = flushOutbox()
+			return err
+		}, func(stack *BufferStack, err error) {
+			stack.flushing = false
+			StatusLine = fmt.Sprintf("Sent %d queued mails.", len(sent))
+			if failed > 0 {
+				StatusLine = fmt.Sprintf("Sent %d queued mails, %d failed.", len(sent), failed)
+			}
+			if err != nil {
+				StatusLine += " " + err.Error()
+			}
+			if err := tagOriginals(sent...); err != nil {
+				StatusLine += " Could not tag originals: " + err.Error()
+			}
+			updateOutboxCount()
+			for _, buf := range stack.buffers {
+				buf.HandleCommand("_refresh", nil, stack)
+			}
+			stack.refresh()
+		})
 	case "refresh":
 		StatusLine = "view refreshed."
 		for _, buf := range b.buffers {
 			buf.HandleCommand("_refresh", nil, b)
 		}
 		b.refresh()
+	case "undo", "redo":
+		err := b.undoCmd(cmd == "redo")
+		if err != nil {
+			StatusLine = err.Error()
+		}
+		for _, buf := range b.buffers {
+			buf.HandleCommand("_refresh", nil, b)
+		}
+		b.refresh()
 	default:
 		return false
 	}
@@ -157,6 +251,10 @@ func (b *BufferStack) HandleEvent(event *termbox.Event) {
 
 	if event.Type == termbox.EventKey {
 		StatusLine = ""
+		if b.question != nil {
+			b.handleQuestionEvent(event)
+			return
+		}
 		if b.prompt.Active() {
 			cmd, args := b.prompt.HandleEvent(event)
 			if len(cmd) != 0 {
@@ -167,6 +265,9 @@ func (b *BufferStack) HandleEvent(event *termbox.Event) {
 				if !accept {
 					invalidCommand(cmd)
 				}
+				if len(b.buffers) > 0 {
+					b.drawBottomBar()
+				}
 				_, h := termbox.Size()
 				printLine(0, h-1, StatusLine, -1, -1)
 			}
@@ -187,6 +288,9 @@ func (b *BufferStack) HandleEvent(event *termbox.Event) {
 		if !accept {
 			invalidCommand(cmd.Command)
 		}
+		if len(b.buffers) > 0 {
+			b.drawBottomBar()
+		}
 
 		if StatusLine != "" {
 			_, h := termbox.Size()
@@ -0,0 +1,179 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package completion
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Address is a mail address together with the number of times it was seen.
+type Address struct {
+	Name  string
+	Addr  string
+	Count int
+}
+
+// String formats the address as it is written in To or Cc fields. Unlike
+// net/mail, names are not encoded so that they stay readable in the editor.
+func (a *Address) String() string {
+	if a.Name == "" {
+		return a.Addr
+	}
+	name := a.Name
+	if strings.ContainsAny(name, "\",.:;<>@()[]\\") {
+		name = "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(name) + "\""
+	}
+	return name + " <" + a.Addr + ">"
+}
+
+// AddressBook collects addresses and ranks them by how often they were seen.
+type AddressBook struct {
+	entries map[string]*Address // indexed by lower case address
+}
+
+// NewAddressBook creates an empty AddressBook.
+func NewAddressBook() *AddressBook {
+	return &AddressBook{make(map[string]*Address)}
+}
+
+// Add counts a use of addr. A non-empty name replaces the name known so far.
+func (b *AddressBook) Add(name, addr string) {
+	addr = strings.TrimSpace(addr)
+	if !strings.Contains(addr, "@") {
+		return
+	}
+	key := strings.ToLower(addr)
+	entry := b.entries[key]
+	if entry == nil {
+		entry = &Address{Addr: addr}
+		b.entries[key] = entry
+	}
+	if name = strings.TrimSpace(name); name != "" {
+		entry.Name = name
+	}
+	entry.Count++
+}
+
+// Match returns all addresses whose address or a word of whose name starts
+// with prefix, ignoring case. The most frequently seen addresses come first.
+func (b *AddressBook) Match(prefix string) []Address {
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	var matches []Address
+	for key, entry := range b.entries {
+		match := strings.HasPrefix(key, prefix)
+		for _, word := range strings.Fields(strings.ToLower(entry.Name)) {
+			match = match || strings.HasPrefix(word, prefix)
+		}
+		if match {
+			matches = append(matches, *entry)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Count != matches[j].Count {
+			return matches[i].Count > matches[j].Count
+		}
+		return matches[i].Addr < matches[j].Addr
+	})
+	return matches
+}
+
+// ReadVCard adds the addresses of all contacts in a vCard file. Each EMAIL
+// property is added with the FN (formatted name) of its contact.
+func (b *AddressBook) ReadVCard(r io.Reader) error {
+	var name string
+	var emails []string
+
+	// continuation lines start with a space or tab
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			continue
+		}
+		// properties may have a group prefix and parameters,
+		// e.g. "item1.EMAIL;TYPE=work:"
+		property := strings.ToUpper(strings.SplitN(line[:colon], ";", 2)[0])
+		if dot := strings.LastIndex(property, "."); dot != -1 {
+			property = property[dot+1:]
+		}
+		value := line[colon+1:]
+
+		switch property {
+		case "BEGIN":
+			name, emails = "", nil
+		case "FN":
+			name = strings.NewReplacer("\\,", ",", "\\;", ";", "\\\\", "\\").Replace(value)
+		case "EMAIL":
+			emails = append(emails, value)
+		case "END":
+			for _, email := range emails {
+				b.Add(name, email)
+			}
+			name, emails = "", nil
+		}
+	}
+	return nil
+}
+
+// ReadAbook adds the addresses of all contacts in an abook addressbook file.
+// The email field of a contact may contain several comma separated addresses.
+func (b *AddressBook) ReadAbook(r io.Reader) error {
+	var name, emails string
+	flush := func() {
+		for _, email := range strings.Split(emails, ",") {
+			b.Add(name, email)
+		}
+		name, emails = "", ""
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "["):
+			flush()
+		case strings.HasPrefix(line, "name="):
+			name = strings.TrimPrefix(line, "name=")
+		case strings.HasPrefix(line, "email="):
+			emails = strings.TrimPrefix(line, "email=")
+		}
+	}
+	flush()
+	return scanner.Err()
+}
+
+// QueryAddress completes the last address in str with the addresses in book.
+// Addresses are separated by commas or, in prompts, by spaces.
+//
+// e.g. QueryAddress(":bounce bob@example.com, al", book) could return
+// {":bounce bob@example.com, Alice <alice@example.com>"}.
+func QueryAddress(str string, book *AddressBook) (matches []string) {
+	start := strings.LastIndexAny(str, " ,") + 1
+	prefix := str[start:]
+	if prefix == "" {
+		return nil
+	}
+
+	for _, addr := range book.Match(prefix) {
+		matches = append(matches, str[:start]+addr.String())
+	}
+	return matches
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package completion
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddressBook(t *testing.T) {
+	book := NewAddressBook()
+	book.Add("", "bob@example.com")
+	book.Add("Alice Smith", "alice@example.com")
+	book.Add("", "Alice@Example.com")
+	book.Add("", "not an address")
+
+	err := book.ReadVCard(strings.NewReader("BEGIN:VCARD\r\nVERSION:3.0\r\n" +
+		"FN:Smith\\, Carol\r\nitem1.EMAIL;TYPE=work:carol@exam\r\n ple.com\r\n" +
+		"EMAIL:carol@home.example\r\nEND:VCARD\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = book.ReadAbook(strings.NewReader("[format]\nprogram=abook\n\n" +
+		"[0]\nname=Dave\nemail=dave@example.com, dave@work.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"ali", []string{"Alice Smith <alice@example.com>"}},
+		{"SMI", []string{"Alice Smith <alice@example.com>",
+			"\"Smith, Carol\" <carol@example.com>", "\"Smith, Carol\" <carol@home.example>"}},
+		{"b", []string{"bob@example.com"}},
+		{"d", []string{"Dave <dave@example.com>", "Dave <dave@work.example>"}},
+		{"x", nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, addr := range book.Match(test.prefix) {
+			got = append(got, addr.String())
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Match(%q) = %q, expected %q", test.prefix, got, test.expected)
+		}
+	}
+
+	matches := QueryAddress(":bounce dave@example.com, al", book)
+	expected := []string{":bounce dave@example.com, Alice Smith <alice@example.com>"}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("got %q", matches)
+	}
+	if matches := QueryAddress(":to ", book); matches != nil {
+		t.Errorf("completed empty prefix to %q", matches)
+	}
+}
@@ -8,10 +8,13 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"net/mail"
 	"net/textproto"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nsf/termbox-go"
@@ -19,13 +22,89 @@ import (
 
 // ComposeBuffer is a MailBuffer that allows editing and sending the viewed message.
 type ComposeBuffer struct {
-	mb   *MailBuffer
-	sent bool
+	mb      *MailBuffer
+	sent    bool
+	sending bool // the mail is being sent in the background
+
+	draftFile string // file of the last saved draft of this mail
+	saved     bool   // the draft is up to date
+
+	discarded      bool // the user chose to throw the mail away
+	closeAfterSend bool // remove the buffer from the stack once the mail is sent
+
+	crypto    cryptoOptions
+	signByCmd bool // signing was chosen with sign/nosign or smime/nosmime
 }
 
+// composeBuffers contains all open ComposeBuffers so that unsent mail can be
+// saved if barely crashes. A crash can happen in any goroutine, so the map is
+// guarded by the mutex.
+var composeBuffers = struct {
+	sync.Mutex
+	buffers map[*ComposeBuffer]bool
+}{buffers: make(map[*ComposeBuffer]bool)}
+
 // NewComposeBuffer creates a new Composebuffer for displaying a mail.
 func NewComposeBuffer(m *Mail) *ComposeBuffer {
-	return &ComposeBuffer{NewMailBufferFromMail(m), false}
+	buf := &ComposeBuffer{mb: NewMailBufferFromMail(m)}
+	buf.setSignDefaults()
+	composeBuffers.Lock()
+	composeBuffers.buffers[buf] = true
+	composeBuffers.Unlock()
+	return buf
+}
+
+// setSignDefaults enables signing as configured for the account of the From
+// address, unless the user chose otherwise with a command.
+func (b *ComposeBuffer) setSignDefaults() {
+	if b.signByCmd {
+		return
+	}
+	account, err := fromAccount(b.mb.mail)
+	if err != nil {
+		return
+	}
+	b.crypto.sign = account.Pgp_Sign
+	b.crypto.smime = account.Smime_Sign && !account.Pgp_Sign && !b.crypto.encrypt
+}
+
+// NewComposeBufferFromDraft creates a new ComposeBuffer to continue editing
+// the draft stored in filename.
+func NewComposeBufferFromDraft(filename string) *ComposeBuffer {
+	m, err := loadDraft(filename)
+	if err != nil {
+		StatusLine = err.Error()
+		return NewComposeBuffer(composeMail())
+	}
+	if !isDraft(filename, m) {
+		// resuming must never delete received mail, so edit a copy
+		StatusLine = "Not a draft, editing a copy."
+		m.Header["Message-Id"] = []string{newMessageID()}
+		m.Header["Date"] = []string{time.Now().Format(time.RFC1123Z)}
+		return NewComposeBuffer(m)
+	}
+	buf := NewComposeBuffer(m)
+	buf.draftFile = filename
+	buf.saved = true
+	return buf
+}
+
+// saveDraft saves the mail as a draft, replacing the previously saved version.
+func (b *ComposeBuffer) saveDraft() error {
+	filename, err := saveDraft(b.mb.mail, b.draftFile)
+	if filename != "" {
+		b.draftFile = filename
+		updateOutboxCount() // resumed mail may come from the outbox
+	}
+	if err == nil {
+		b.saved = true
+	}
+	return err
+}
+
+// unsaved returns true if closing the buffer would lose the mail.
+func (b *ComposeBuffer) unsaved() bool {
+	return !b.sent && !b.saved && !b.discarded
 }
 
 // Draw draws the buffer content.
@@ -35,11 +114,22 @@ func (b *ComposeBuffer) Draw() {
 
 // Title returns the buffer's title string.
 func (b *ComposeBuffer) Title() string {
+	title := "unsent"
 	if b.sent {
-		return "sent"
-	} else {
-		return "unsent"
+		title = "sent"
+	} else if b.sending {
+		title = "sending"
 	}
+	if b.crypto.sign {
+		title += " [signed]"
+	}
+	if b.crypto.encrypt {
+		title += " [encrypted]"
+	}
+	if b.crypto.smime {
+		title += " [S/MIME signed]"
+	}
+	return title
 }
 
 // Name returns the buffer's name.
@@ -49,11 +139,32 @@ func (b *ComposeBuffer) Name() string {
 
 // Close closes the buffer.
 func (b *ComposeBuffer) Close() {
+	composeBuffers.Lock()
+	delete(composeBuffers.buffers, b)
+	composeBuffers.Unlock()
 	b.mb.Close()
 }
 
+// editHeaders are always written to the editor template, in this order.
+var editHeaders = []string{"From", "To", "Cc", "Bcc", "Subject"}
+
+// hiddenHeaders are managed by barely and left out of the editor template.
+var hiddenHeaders = map[string]bool{
+	"Mime-Version":              true,
+	"User-Agent":                true,
+	"Message-Id":                true,
+	"Date":                      true,
+	"In-Reply-To":               true,
+	"References":                true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	ForwardedHeader:             true,
+}
+
 // writeEditString writes an editable version of a mail consisting of a
-// header paragraph containing some of the mails headers and the message body.
+// header paragraph containing the mails headers and the message body.
+// From, To, Cc, Bcc and Subject are always present, followed by any other
+// headers that are not managed by barely itself.
 //
 // The format is as follows:
 //
@@ -70,9 +181,37 @@ func writeEditString(filename string, m *Mail) error {
 	}
 	defer file.Close()
 
-	file.Write([]byte("From: " + m.Header.Get("From") + "\n"))
-	file.Write([]byte("To: " + m.Header.Get("To") + "\n"))
-	file.Write([]byte("Subject: " + m.Header.Get("Subject") + "\n"))
+	writeField := func(key string, values []string) {
+		if len(values) == 0 {
+			values = []string{""}
+		}
+		for _, value := range values {
+			file.Write([]byte(key + ": " + value + "\n"))
+		}
+	}
+
+	header := make(map[string][]string, len(m.Header))
+	var extra []string
+	for key, values := range m.Header {
+		key = textproto.CanonicalMIMEHeaderKey(key)
+		if hiddenHeaders[key] {
+			continue
+		}
+		if _, ok := header[key]; !ok {
+			extra = append(extra, key)
+		}
+		header[key] = append(header[key], values...)
+	}
+	for _, key := range editHeaders {
+		writeField(key, header[key])
+		delete(header, key)
+	}
+	sort.Strings(extra)
+	for _, key := range extra {
+		if values, ok := header[key]; ok {
+			writeField(key, values)
+		}
+	}
 	file.Write([]byte{'\n'})
 
 	// assume the first part exists, is text/plain, and contains the message body.
@@ -87,7 +226,8 @@ func writeEditString(filename string, m *Mail) error {
 }
 
 // parseEditString parses a string created by writeEditString and edited by the user.
-// it updates the changed header flags and message body.
+// The header paragraph replaces all headers that writeEditString shows; fields the
+// user left empty are removed. It also updates the message body.
 func parseEditString(filename string, m *Mail) error {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -96,6 +236,9 @@ func parseEditString(filename string, m *Mail) error {
 	defer file.Close()
 	var buf bytes.Buffer
 
+	header := make(map[string][]string)
+	lastKey := ""
+
 	scanner := bufio.NewScanner(file)
 	scanHeaders := true
 	for scanner.Scan() {
@@ -104,12 +247,20 @@ func parseEditString(filename string, m *Mail) error {
 			continue
 		}
 		if scanHeaders {
-			toks := strings.SplitN(scanner.Text(), ":", 2)
-			if len(toks) != 2 {
+			line := scanner.Text()
+			if (line[0] == ' ' || line[0] == '\t') && lastKey != "" {
+				// folded field
+				values := header[lastKey]
+				values[len(values)-1] = strings.TrimSpace(values[len(values)-1] + " " +
+					strings.TrimSpace(line))
+				continue
+			}
+			toks := strings.SplitN(line, ":", 2)
+			if len(toks) != 2 || strings.TrimSpace(toks[0]) == "" {
 				return errors.New("Error: invalid header section.")
 			}
-			m.Header[strings.TrimSpace(toks[0])] =
-				[]string{strings.TrimSpace(toks[1])}
+			lastKey = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(toks[0]))
+			header[lastKey] = append(header[lastKey], strings.TrimSpace(toks[1]))
 		} else {
 			_, err := buf.WriteString(scanner.Text() + "\n")
 			if err != nil {
@@ -124,10 +275,39 @@ func parseEditString(filename string, m *Mail) error {
 	if len(m.Parts) == 0 {
 		return errors.New("Error: editing invalid mail.")
 	}
+
+	for key := range m.Header {
+		canonical := textproto.CanonicalMIMEHeaderKey(key)
+		if !hiddenHeaders[canonical] || header[canonical] != nil {
+			delete(m.Header, key)
+		}
+	}
+	for key, values := range header {
+		var nonEmpty []string
+		for _, value := range values {
+			if value != "" {
+				nonEmpty = append(nonEmpty, value)
+			}
+		}
+		if len(nonEmpty) > 0 {
+			m.Header[key] = nonEmpty
+		}
+	}
+
 	m.Parts[0].Body = buf.String()
 	return nil
 }
 
+// addRecipients appends the comma separated addresses in addrs to the
+// address list in the header field key.
+func addRecipients(header mail.Header, key, addrs string) {
+	addrs = strings.TrimRight(addrs, ", ")
+	if old := header.Get(key); old != "" {
+		addrs = old + ", " + addrs
+	}
+	header[key] = []string{addrs}
+}
+
 func (b *ComposeBuffer) openEditor(stack *BufferStack) {
 	filename := b.mb.tmpDir + "/edit.eml"
 
@@ -152,30 +332,129 @@ func (b *ComposeBuffer) openEditor(stack *BufferStack) {
 		StatusLine = err.Error()
 	}
 	b.mb.mail.Header["Date"] = []string{time.Now().Format(time.RFC1123Z)}
+	b.setSignDefaults() // the From address may have changed
 	b.mb.refreshBuf()
 	stack.refresh()
 }
 
+// finishSent marks the mail as sent after it was sent or queued. Its draft
+// is removed and the buffer is closed if requested.
+func (b *ComposeBuffer) finishSent(stack *BufferStack) {
+	b.sent = true
+	if b.draftFile != "" {
+		if err := removeMailFile(b.draftFile); err != nil {
+			StatusLine += " Could not remove draft: " + err.Error()
+		}
+		b.draftFile = ""
+		updateOutboxCount() // resumed mail may come from the outbox
+	}
+	if b.closeAfterSend {
+		stack.remove(b)
+		if stack.quitting {
+			stack.quit()
+		}
+	}
+}
+
 // HandleCommand executes buffer local commands.
 func (b *ComposeBuffer) HandleCommand(cmd string, args []string, stack *BufferStack) bool {
+	if b.sending {
+		switch cmd {
+		case "edit", "send", "queue", "attach", "deattach", "savedraft", "postpone",
+			"sign", "nosign", "encrypt", "noencrypt", "smime", "nosmime", "to", "cc", "bcc":
+			StatusLine = "Mail is being sent"
+			return true
+		}
+	}
+
 	switch cmd {
-	case "reply", "raw": // disallow invalid commands in compose mode
+	case "reply", "groupreply", "listreply", "forward", "forwardattach", "bounce", "raw", "resume": // disallow invalid commands in compose mode
 	case "edit":
+		b.saved = false
 		b.openEditor(stack)
 	case "send":
 		if b.sent {
 			StatusLine = "Mail already sent"
 			break
 		}
+		b.sending = true
 		StatusLine = "Sending..."
 		stack.refresh()
-		err := sendMail(b.mb.mail)
+		// the mail is encoded while the buffer keeps drawing it
+		m, crypto := b.mb.mail.clone(), b.crypto
+		var warning string
+		runAsync(func() (err error) {
+			warning, err = sendMail(m, crypto)
+			return err
+		}, func(stack *BufferStack, err error) {
+			b.sending = false
+			if _, queued := err.(*queuedError); err != nil && !queued {
+				StatusLine = err.Error()
+				b.closeAfterSend = false
+				stack.quitting = false
+			} else {
+				StatusLine = "Mail sent."
+				if warning != "" {
+					StatusLine += " " + warning
+				}
+				if queued {
+					StatusLine = err.Error()
+					updateOutboxCount()
+				} else if err := tagOriginals(m.Header); err != nil {
+					StatusLine += " Could not tag original: " + err.Error()
+				}
+				b.finishSent(stack)
+			}
+			stack.refresh()
+		})
+	case "queue":
+		if b.sent {
+			StatusLine = "Mail already sent"
+			break
+		}
+		err := queueMail(b.mb.mail, b.crypto)
 		if err != nil {
 			StatusLine = err.Error()
-		} else {
-			StatusLine = "Mail sent."
-			b.sent = true
-			stack.refresh()
+			break
+		}
+		StatusLine = "Mail queued in outbox."
+		updateOutboxCount()
+		b.finishSent(stack)
+		stack.refresh()
+	case "sign", "nosign":
+		b.signByCmd = true
+		b.crypto.sign = cmd == "sign"
+		if b.crypto.sign {
+			b.crypto.smime = false
+		}
+		stack.refresh()
+	case "encrypt", "noencrypt":
+		b.crypto.encrypt = cmd == "encrypt"
+		if b.crypto.encrypt {
+			b.crypto.smime = false
+		}
+		stack.refresh()
+	case "smime", "nosmime":
+		// S/MIME and PGP exclude each other
+		b.signByCmd = true
+		b.crypto.smime = cmd == "smime"
+		if b.crypto.smime {
+			b.crypto.sign, b.crypto.encrypt = false, false
+		}
+		stack.refresh()
+	case "savedraft", "postpone":
+		if b.sent {
+			StatusLine = "Mail already sent"
+			break
+		}
+		err := b.saveDraft()
+		if err != nil {
+			StatusLine = err.Error()
+			break
+		}
+		StatusLine = "Draft saved."
+		if cmd == "postpone" {
+			stack.Pop()
 		}
 	case "attach":
 		if len(args) == 0 {
@@ -183,6 +462,7 @@ func (b *ComposeBuffer) HandleCommand(cmd string, args []string, stack *BufferSt
 			break
 		}
 
+		b.saved = false
 		err := b.mb.mail.attachFile(expandEnvHome(strings.Join(args, " ")))
 		if err != nil {
 			StatusLine = err.Error()
@@ -191,7 +471,18 @@ func (b *ComposeBuffer) HandleCommand(cmd string, args []string, stack *BufferSt
 		}
 		b.mb.refreshBuf()
 		b.Draw()
+	case "to", "cc", "bcc":
+		if len(args) == 0 {
+			StatusLine = "Usage: " + cmd + " <addresses>"
+			break
+		}
+		key := map[string]string{"to": "To", "cc": "Cc", "bcc": "Bcc"}[cmd]
+		b.saved = false
+		addRecipients(b.mb.mail.Header, key, strings.Join(args, " "))
+		b.mb.refreshBuf()
+		b.Draw()
 	case "deattach":
+		b.saved = false
 		if len(b.mb.mail.Parts) > 1 {
 			b.mb.mail.Parts = b.mb.mail.Parts[:len(b.mb.mail.Parts)-1]
 		}
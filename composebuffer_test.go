@@ -0,0 +1,113 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/laochailan/barely/completion"
+)
+
+func TestEditString(t *testing.T) {
+	dir, err := ioutil.TempDir("", "barely-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "edit.eml")
+
+	m := testMail()
+	m.Header["X-Old"] = []string{"removed by the user"}
+	err = writeEditString(filename, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "From: Alice <alice@example.com>\nTo: Bob <bob@example.com>\nCc: \nBcc: \n" +
+		"Subject: test\nX-Old: removed by the user\n\n"
+	if !strings.HasPrefix(string(written), expected) {
+		t.Errorf("template starts with %q, expected %q", written, expected)
+	}
+
+	edited := "From: Alice <alice@example.com>\nTo: Bob <bob@example.com>,\n Carol <carol@example.com>\n" +
+		"cc: \nBcc: dave@example.com\nSubject: changed\nreply-to: list@example.com\n\nBody\n"
+	err = ioutil.WriteFile(filename, []byte(edited), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = parseEditString(filename, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range map[string][]string{
+		"To":       {"Bob <bob@example.com>, Carol <carol@example.com>"},
+		"Cc":       nil,
+		"Bcc":      {"dave@example.com"},
+		"Subject":  {"changed"},
+		"Reply-To": {"list@example.com"},
+		"X-Old":    nil,
+	} {
+		if !reflect.DeepEqual(m.Header[key], value) {
+			t.Errorf("%s is %q, expected %q", key, m.Header[key], value)
+		}
+	}
+	if m.Header["Message-ID"] == nil {
+		t.Error("hidden Message-ID was removed")
+	}
+	if m.Parts[0].Body != "Body\n" {
+		t.Errorf("body is %q", m.Parts[0].Body)
+	}
+
+	addrs, err := m.addresses("To", "Cc", "Bcc")
+	if err != nil || !reflect.DeepEqual(addrs, []string{"bob@example.com", "carol@example.com", "dave@example.com"}) {
+		t.Errorf("got addresses %v, %v", addrs, err)
+	}
+	m.Header["Cc"] = []string{"not an address"}
+	if _, err := m.addresses("To", "Cc", "Bcc"); err == nil {
+		t.Error("invalid Cc accepted")
+	}
+}
+
+func TestAddRecipients(t *testing.T) {
+	book := completion.NewAddressBook()
+	book.Add("Jürgen", "j@example.com")
+	book.Add("Müller, Hans", "hans@example.com")
+
+	// complete the arguments of :cc the way the prompt does
+	line := ":cc"
+	for _, prefix := range []string{" jü", ", mü"} {
+		matches := completion.QueryAddress(line+prefix, book)
+		if len(matches) != 1 {
+			t.Fatalf("%q completed to %q", line+prefix, matches)
+		}
+		line = matches[0]
+	}
+
+	m := testMail()
+	addRecipients(m.Header, "Cc", strings.Join(strings.Fields(line)[1:], " "))
+	encoded, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Cc: =?utf-8?q?J=C3=BCrgen?= <j@example.com>, " +
+		"=?utf-8?b?TcO8bGxlciwgSGFucw==?= <hans@example.com>\r\n"
+	if !strings.HasPrefix(encoded, expected) {
+		t.Errorf("encoded %q, expected %q", encoded, expected)
+	}
+
+	addrs, err := readEncoded(t, encoded).addresses("Cc")
+	if err != nil || !reflect.DeepEqual(addrs, []string{"j@example.com", "hans@example.com"}) {
+		t.Errorf("got addresses %v, %v", addrs, err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"unicode/utf8"
 
+	"github.com/laochailan/notmuch-go"
 	termbox "github.com/nsf/termbox-go"
 	"gopkg.in/gcfg.v1"
 )
@@ -24,6 +25,7 @@ var specialKeys = map[string]termbox.Key{
 	"pageup":   termbox.KeyPgup,
 	"pagedown": termbox.KeyPgdn,
 	"enter":    termbox.KeyEnter,
+	"space":    termbox.KeySpace,
 }
 
 // KeyBinding represents a single keybinding.
@@ -72,6 +74,26 @@ type Account struct {
 	Sent_Tag         []string
 	Sent_Dir         string
 	Draft_Dir        string
+	Outbox_Dir       string
+
+	Pgp_Key  string
+	Pgp_Sign bool
+
+	Smime_Cert string
+	Smime_Key  string
+	Smime_Sign bool
+
+	Smtp_Host             string
+	Smtp_Port             int
+	Smtp_Security         string
+	Smtp_User             string
+	Smtp_Auth             string
+	Smtp_Password_Command string
+
+	Signature         string
+	Signature_Command string
+	Reply_Attribution string
+	Forward_Header    string
 }
 
 // TagAlias represents an alias for tags.
@@ -104,6 +126,67 @@ func (t *TagAlias) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// SortOrder is the order in which search results are displayed.
+type SortOrder notmuch.Sort
+
+var sortOrderNames = map[string]SortOrder{
+	"newest-first": SortOrder(notmuch.SORT_NEWEST_FIRST),
+	"oldest-first": SortOrder(notmuch.SORT_OLDEST_FIRST),
+	"message-id":   SortOrder(notmuch.SORT_MESSAGE_ID),
+	// unsorted results come in the order they are stored in the database.
+	"unsorted": SortOrder(notmuch.SORT_UNSORTED),
+}
+
+// sortOrderAliases are accepted in addition to sortOrderNames. notmuch has no
+// ranking by relevance, so "relevance" is the unsorted order.
+var sortOrderAliases = map[string]SortOrder{
+	"relevance": SortOrder(notmuch.SORT_UNSORTED),
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaller interface.
+func (s *SortOrder) UnmarshalText(text []byte) error {
+	name := strings.TrimSpace(string(text))
+	order, ok := sortOrderNames[name]
+	if !ok {
+		order, ok = sortOrderAliases[name]
+	}
+	if !ok {
+		return fmt.Errorf("Unknown sort order '%s'. Use newest-first, oldest-first, message-id or unsorted.", text)
+	}
+	*s = order
+	return nil
+}
+
+// String returns the config name of the sort order.
+func (s SortOrder) String() string {
+	for name, order := range sortOrderNames {
+		if order == s {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// SortRule sets the default sort order for a search term.
+type SortRule struct {
+	order SortOrder
+	term  string
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaller interface.
+func (r *SortRule) UnmarshalText(text []byte) error {
+	fields := strings.Fields(string(text))
+	if len(fields) < 2 {
+		return errors.New("Sort rules must be of form 'order searchterm'.")
+	}
+	err := r.order.UnmarshalText([]byte(fields[0]))
+	if err != nil {
+		return err
+	}
+	r.term = strings.Join(fields[1:], " ")
+	return nil
+}
+
 // Config holds all configuration values.
 // Refer to gcfg documentation for the resulting config file syntax.
 type Config struct {
@@ -111,6 +194,10 @@ type Config struct {
 		Database          string
 		Initial_Command   string
 		Synchronize_Flags bool
+		Search_Format     SearchFormat
+		Refresh_Interval  int
+		Smime_Ca_File     string
+		Address_Book      []string
 	}
 
 	Bindings map[string]*KeyBindings
@@ -128,6 +215,8 @@ type Config struct {
 		HlFg int
 
 		Quote int
+
+		Mark int
 	}
 
 	Commands struct {
@@ -135,6 +224,9 @@ type Config struct {
 		Editor      string
 
 		HtmlDump string
+
+		Gpg     string
+		Openssl string
 	}
 
 	Account map[string]*Account
@@ -142,6 +234,11 @@ type Config struct {
 	Tags struct {
 		Alias []*TagAlias
 	}
+
+	Sort struct {
+		Default SortOrder
+		Search  []*SortRule
+	}
 }
 
 // PostConfig contains post processed config fields, e.g. values
@@ -149,6 +246,8 @@ type Config struct {
 type PostConfig struct {
 	TagAliases map[string]string
 	TagColors  map[string]int
+
+	SearchSorts map[string]SortOrder
 }
 
 const (
@@ -174,19 +273,74 @@ initial-command=msearch tag:unread
 # Whether barely should add matching maildir tags after changing
 # message tags.
 synchronize-flags=true
+# Layout of the lines in search buffers. Fields are written as %name,
+# %name:N to pad or truncate them to N columns and %name:>N to also
+# align them to the right. Available fields are date, authors (short),
+# from (full), to, list, tags, subject, count (matched/total messages
+# of threads) and tree (reply structure in thread buffers).
+search-format=%date:8 %tags %tree%authors %count %subject
+# Interval in seconds in which the database is checked for changes, e.g. by
+# "notmuch new". The current buffer is refreshed on changes. 0 disables this.
+refresh-interval=5
+# CA certificates (PEM) S/MIME signatures are checked against. By default,
+# openssl's default certificate store is used.
+smime-ca-file=
+# Address completion in the to, cc, bcc and bounce prompts uses the senders
+# and recipients of mail in the database. Contacts from abook addressbook
+# files or vCard files (ending in .vcf) can be added with address-book,
+# which may be given more than once.
+# address-book = ~/.abook/addressbook
 
 # For every address you want to send mail with, there has to be an
 # account section like this one. the addr, sendmail-command and
 # sent-dir are mandatory for sending.
+# Instead of a sendmail-command, mail can be submitted to an SMTP server
+# directly by setting smtp-host. smtp-security is starttls (default),
+# tls or none, smtp-port defaults to 587 (465 for tls). If smtp-user is
+# set, barely authenticates with the password printed by
+# smtp-password-command using smtp-auth plain or login (default: plain
+# if the server supports it).
 # draft-dir is mandatory for saving drafts of course.
+# Mail that cannot be sent for the moment, e.g. without network, or is queued
+# with the queue command, is kept in outbox-dir tagged outbox until the
+# flushqueue command sends it. Resuming queued mail takes it out of the outbox
+# to edit it.
+# The sendmail-command is run without -t. All recipients, including those
+# in Bcc, are passed as arguments, and the Bcc field is removed from the mail.
+# Bounced mail is passed the same way with the new recipients.
+# pgp-key selects the key used for signing (default: gpg's default key)
+# and pgp-sign whether mail from this account is signed by default.
+# smime-cert and smime-key are PEM files with the certificate and private
+# key for S/MIME. They are used for signing if smime-sign is true or the
+# smime command is given in the compose buffer, and for decryption.
+# The signature file, or the output of signature-command, is appended to new
+# mail, replies and forwards from this account.
+# reply-attribution is the line introducing the quote in replies (default:
+# "Quoting %name (%date):") and forward-header the line starting forwarded
+# messages. In both, %name, %addr, %date and %subject are replaced by the
+# author, date and subject of the original message.
 #
 # [account "example"]
 # addr = example@example.com
-# sendmail-command = msmtp --account=example -t
+# sendmail-command = msmtp --account=example
 # sent-dir = $HOME/mail/example/sent
 # draft-dir = $HOME/mail/example/draft
+# outbox-dir = $HOME/mail/example/outbox
 # sent-tag = sent
 # sent-tag = example
+# pgp-key = 0x12345678
+# pgp-sign = false
+# smime-cert = $HOME/.smime/example.crt
+# smime-key = $HOME/.smime/example.key
+# smime-sign = false
+# smtp-host = mail.example.com
+# smtp-port = 587
+# smtp-security = starttls
+# smtp-user = example
+# smtp-password-command = pass show mail/example
+# signature = $HOME/.signature
+# reply-attribution = "On %date, %name wrote:"
+# forward-header = "---------- Forwarded message ----------"
 
 [commands]
 # program used to open all tpyes of attachments
@@ -195,6 +349,10 @@ attachments=xdg-open
 editor=vim
 # html to plaintext converter
 htmldump=w3m -dump
+# gpg program used for signing, encryption and key lookup
+gpg=gpg
+# openssl program used for S/MIME
+openssl=openssl
 
 # This section describes the color theme. Colors are numbers
 # in the terminal 256 color cube.
@@ -213,6 +371,8 @@ hlfg = 147
 
 quote = 80
 
+mark = 161
+
 # The bindings sections contain keybinding definitions of the
 # form
 #	key = KEY COMMAND ARGS...
@@ -226,6 +386,9 @@ key = / prompt search
 key = : prompt
 key = ? help
 key = @ refresh
+key = u undo
+key = U redo
+key = Y flushqueue
 
 [bindings "search"]
 key = up move up
@@ -233,8 +396,43 @@ key = down move down
 key = pageup move pageup
 key = pagedown move pagedown
 key = enter show
+key = c conversation
 key = s untag unread
 key = & tag deleted
+key = t mark
+key = T prompt markpattern
+key = * markall
+key = ! invertmarks
+key = o prompt sort
+key = e resume
+
+[bindings "thread"]
+key = up move up
+key = down move down
+key = pageup move pageup
+key = pagedown move pagedown
+key = enter show
+key = c conversation
+key = s untag unread
+key = & tag deleted
+
+[bindings "conversation"]
+key = up move up
+key = down move down
+key = pageup move pageup
+key = pagedown move pagedown
+key = J move nextmsg
+key = K move prevmsg
+key = enter show
+key = space toggle
+key = + unfoldall
+key = - foldall
+key = r reply
+key = R groupreply
+key = L listreply
+key = f forward
+key = F forwardattach
+key = b prompt bounce
 
 [bindings "mail"]
 key = up move up
@@ -244,6 +442,11 @@ key = pagedown move pagedown
 key = enter show
 key = r reply
 key = R groupreply
+key = L listreply
+key = f forward
+key = F forwardattach
+key = b prompt bounce
+key = e resume
 key = / prompt search
 key = | prompt search
 key = n search
@@ -258,10 +461,23 @@ key = enter edit
 key = y send
 key = a prompt attach
 key = A deattach
+key = P postpone
+key = S savedraft
+key = s sign
+key = x nosign
+key = c encrypt
+key = C noencrypt
+key = m smime
+key = M nosmime
+key = Q queue
+key = t prompt to
+key = T prompt cc
+key = B prompt bcc
 
 # The tags section can be used to set display aliases for tags.
 # This can be used to hide or abbreviate common tags and to color important
-# tags to highlight unread mail for example.
+# tags to highlight unread mail for example. Messages are tagged replied
+# or passed once a reply or forward of them has been sent.
 #
 # [tags]
 # alias = replied >
@@ -269,6 +485,15 @@ key = A deattach
 # alias = sent  # empty alias means hiding tag
 # alias = unread unread 87 # highlight the unread tag in color 87
 
+# The sort section sets the order of search results. Possible orders are
+# newest-first, oldest-first, message-id and unsorted. As notmuch cannot sort
+# by relevance, relevance is accepted as another name for unsorted.
+[sort]
+default = newest-first
+# Searches for exactly the given term use a different order.
+#
+# search = oldest-first tag:support
+
 `
 
 func preparePostConfig(pcfg *PostConfig, cfg *Config) {
@@ -280,6 +505,11 @@ func preparePostConfig(pcfg *PostConfig, cfg *Config) {
 			pcfg.TagColors[a.tag] = a.color
 		}
 	}
+
+	pcfg.SearchSorts = make(map[string]SortOrder)
+	for _, r := range cfg.Sort.Search {
+		pcfg.SearchSorts[r.term] = r.order
+	}
 }
 
 // removeDoubleBindings removes double KeyBindings in the config giving the last defined binding
@@ -336,6 +566,14 @@ func getBinding(section string, Ch rune, Key termbox.Key) *KeyBinding {
 	return nil
 }
 
+// getSortOrder returns the configured sort order for a search term.
+func getSortOrder(term string) SortOrder {
+	if order, ok := pconfig.SearchSorts[term]; ok {
+		return order
+	}
+	return config.Sort.Default
+}
+
 // getAccount fetches an account for a given mail address.
 func getAccount(addr string) *Account {
 	for _, val := range config.Account {
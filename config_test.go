@@ -0,0 +1,34 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/laochailan/notmuch-go"
+)
+
+func TestSortRule(t *testing.T) {
+	var r SortRule
+	err := r.UnmarshalText([]byte("oldest-first tag:support and to:me"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.order != SortOrder(notmuch.SORT_OLDEST_FIRST) || r.term != "tag:support and to:me" {
+		t.Errorf("parsed %v %q", r.order, r.term)
+	}
+
+	var order SortOrder
+	if order.UnmarshalText([]byte("relevance")) != nil || order.String() != "unsorted" {
+		t.Errorf("relevance parsed as %v", order)
+	}
+
+	if r.UnmarshalText([]byte("sideways tag:support")) == nil {
+		t.Error("accepted unknown sort order")
+	}
+	if r.UnmarshalText([]byte("oldest-first")) == nil {
+		t.Error("accepted rule without search term")
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/mail"
+	"os"
+
+	"github.com/laochailan/notmuch-go"
+	termbox "github.com/nsf/termbox-go"
+)
+
+// convMessage is a single message displayed in a ConversationBuffer.
+type convMessage struct {
+	filename string
+	mail     *Mail
+	prefix   string // tree connectors as in the ThreadBuffer
+	folded   bool
+}
+
+// ConversationBuffer displays all messages of a thread one after another.
+// Each message can be folded to only show a summary line. Messages that
+// were already read are folded initially.
+type ConversationBuffer struct {
+	threadid string
+	messages []convMessage
+
+	buffer    []termbox.Cell
+	msgLines  []int   // lines of the summary of each message
+	partLines [][]int // lines of the part headers of each message
+
+	cursor  int
+	tmpDir  string
+	loading bool // the mails are still read in the background
+	closed  bool
+}
+
+// hasTag returns true if msg is tagged with tag.
+func hasTag(msg *notmuch.Message, tag string) bool {
+	tags := msg.GetTags()
+	if tags == nil {
+		return false
+	}
+	for tags.Valid() {
+		if tags.Get() == tag {
+			return true
+		}
+		tags.MoveToNext()
+	}
+	return false
+}
+
+// NewConversationBuffer creates a ConversationBuffer for the thread with id threadid.
+func NewConversationBuffer(threadid string) *ConversationBuffer {
+	buf := new(ConversationBuffer)
+	buf.threadid = threadid
+
+	err := os.MkdirAll(tmpDir(), 0755)
+	if err == nil {
+		buf.tmpDir, err = ioutil.TempDir(tmpDir(), "conversation")
+	}
+	if err != nil {
+		StatusLine = "Could not open TempDir: " + err.Error()
+	}
+
+	err = buf.loadThread()
+	if err != nil {
+		StatusLine = err.Error()
+	}
+	buf.refreshBuf()
+	buf.readMails()
+
+	// start at the first unread message
+	buf.cursor = -1
+	for i, m := range buf.messages {
+		if !m.folded {
+			buf.cursor = buf.msgLines[i]
+			break
+		}
+	}
+	if buf.cursor == -1 && len(buf.msgLines) > 0 {
+		buf.cursor = buf.msgLines[len(buf.msgLines)-1]
+	}
+	buf.cursor = max(0, buf.cursor)
+
+	return buf
+}
+
+// loadThread lists all messages of the thread in thread order. Until
+// readMails is done, they only contain the headers known to notmuch.
+func (b *ConversationBuffer) loadThread() error {
+	db, status := notmuch.OpenDatabase(expandEnvHome(config.General.Database), 0)
+	if status != notmuch.STATUS_SUCCESS {
+		return errors.New(status.String())
+	}
+	defer db.Close()
+
+	query := db.CreateQuery("thread:" + b.threadid)
+	defer query.Destroy()
+	threads := query.SearchThreads()
+	if threads == nil || !threads.Valid() {
+		return errors.New("Thread not found")
+	}
+
+	b.messages = b.messages[:0]
+	walkThread(threads.Get().GetToplevelMessages(), "", true,
+		func(msg *notmuch.Message, prefix string) {
+			m := &Mail{Header: make(mail.Header)}
+			for _, key := range []string{"Date", "From", "To", "Cc", "Subject"} {
+				if value := msg.GetHeader(key); value != "" {
+					m.Header[key] = []string{value}
+				}
+			}
+			b.messages = append(b.messages,
+				convMessage{msg.GetFileName(), m, prefix, !hasTag(msg, "unread")})
+		})
+	return nil
+}
+
+// readMails reads the messages in the background, as decrypting them with gpg
+// or openssl can take a while. The buffer is updated when all are read.
+func (b *ConversationBuffer) readMails() {
+	filenames := make([]string, len(b.messages))
+	for i, m := range b.messages {
+		filenames[i] = m.filename
+	}
+	mails := make([]*Mail, len(filenames))
+
+	b.loading = true
+	runAsync(func() (err error) {
+		for i, filename := range filenames {
+			m, rerr := readMail(filename)
+			if rerr != nil {
+				err = rerr
+				continue
+			}
+			mails[i] = m
+		}
+		return err
+	}, func(stack *BufferStack, err error) {
+		b.loading = false
+		if b.closed {
+			return
+		}
+		if err != nil {
+			StatusLine = err.Error()
+		}
+		for i, m := range mails {
+			if m != nil {
+				b.messages[i].mail = m
+			}
+		}
+		idx := b.messageAt(b.cursor)
+		b.refreshBuf()
+		if idx >= 0 {
+			b.cursor = b.msgLines[idx]
+		}
+		stack.refresh()
+	})
+}
+
+// stillLoading sets the status line and returns true if the mails are not
+// read yet.
+func (b *ConversationBuffer) stillLoading() bool {
+	if b.loading {
+		StatusLine = "Still reading the thread..."
+	}
+	return b.loading
+}
+
+// refreshBuf preformats all messages so that redrawing while scrolling is faster.
+func (b *ConversationBuffer) refreshBuf() {
+	w, _ := termbox.Size()
+	b.buffer = b.buffer[:0]
+	b.msgLines = make([]int, len(b.messages))
+	b.partLines = make([][]int, len(b.messages))
+
+	y := 0
+	for i, m := range b.messages {
+		b.msgLines[i] = y
+
+		marker := "▾ "
+		if m.folded {
+			marker = "▸ "
+		}
+		date := ""
+		if t, err := m.mail.Header.Date(); err == nil {
+			date = shortTime(t) + " "
+		}
+		summary := marker + m.prefix + date + shortFrom(decodeHeader(m.mail, "From")) +
+			"  " + decodeHeader(m.mail, "Subject")
+		b.buffer, y = formatLine(b.buffer, y, w, summary,
+			termbox.Attribute(config.Theme.From)|termbox.AttrBold)
+
+		if m.folded {
+			continue
+		}
+
+		for _, key := range []string{"Date", "From", "To", "Cc"} {
+			value := decodeHeader(m.mail, key)
+			if value == "" {
+				continue
+			}
+			b.buffer, y = formatLine(b.buffer, y, w, "| "+key+": "+value,
+				termbox.Attribute(config.Theme.Subject))
+		}
+		if sec := m.mail.Security.String(); sec != "" {
+			fg := config.Theme.Subject
+			if m.mail.Security.Bad() {
+				fg = config.Theme.Error
+			}
+			b.buffer, y = formatLine(b.buffer, y, w, "| Security: "+sec, termbox.Attribute(fg))
+		}
+		b.buffer, y, b.partLines[i] = formatParts(b.buffer, y, w, m.mail, b.tmpDir)
+		b.buffer, y = formatLine(b.buffer, y, w, "", 0)
+	}
+
+	if b.cursor >= len(b.buffer)/w {
+		b.cursor = max(0, len(b.buffer)/w-1)
+	}
+}
+
+// messageAt returns the index of the message displayed in line y.
+func (b *ConversationBuffer) messageAt(y int) int {
+	idx := -1
+	for i, l := range b.msgLines {
+		if l > y {
+			break
+		}
+		idx = i
+	}
+	return idx
+}
+
+// setFolded folds or unfolds message idx and moves the cursor to its summary line.
+func (b *ConversationBuffer) setFolded(idx int, folded bool) {
+	if idx < 0 || idx >= len(b.messages) {
+		return
+	}
+	b.messages[idx].folded = folded
+	b.refreshBuf()
+	b.cursor = b.msgLines[idx]
+}
+
+// Draw draws the content of the buffer.
+func (b *ConversationBuffer) Draw() {
+	w, h := termbox.Size()
+	cbuf := termbox.CellBuffer()
+
+	offset := 0
+	if b.cursor >= h*3/4 {
+		offset = -h*3/4 + b.cursor
+	}
+
+	y := 0
+	for ; y < min(len(b.buffer)/w-offset, h-2); y++ {
+		for x := 0; x < w; x++ {
+			cbuf[y*w+x] = b.buffer[(y+offset)*w+x]
+		}
+	}
+
+	for ; y < h-2; y++ {
+		for x := 0; x < w; x++ {
+			cbuf[y*w+x] = termbox.Cell{Ch: 0, Fg: 0, Bg: 0}
+		}
+	}
+
+	if b.cursor-offset >= 0 && b.cursor-offset < h-2 {
+		for x := 0; x < w; x++ {
+			cbuf[(b.cursor-offset)*w+x].Bg = termbox.Attribute(config.Theme.HlBg)
+		}
+	}
+}
+
+// Title returns the title string of the buffer.
+func (b *ConversationBuffer) Title() string {
+	return "conversation thread:" + b.threadid
+}
+
+// Name returns the name of the buffer.
+func (b *ConversationBuffer) Name() string {
+	return "conversation"
+}
+
+// Close closes the buffer.
+func (b *ConversationBuffer) Close() {
+	b.closed = true
+	os.RemoveAll(b.tmpDir)
+}
+
+// HandleCommand handles buffer local commands.
+func (b *ConversationBuffer) HandleCommand(cmd string, args []string, stack *BufferStack) bool {
+	w, h := termbox.Size()
+	switch cmd {
+	case "move":
+		if len(args) == 0 {
+			break
+		}
+		switch args[0] {
+		case "up":
+			b.cursor--
+		case "down":
+			b.cursor++
+		case "pageup":
+			b.cursor -= h / 2
+		case "pagedown":
+			b.cursor += h / 2
+		case "nextmsg":
+			if idx := b.messageAt(b.cursor); idx+1 < len(b.msgLines) {
+				b.cursor = b.msgLines[idx+1]
+			}
+		case "prevmsg":
+			idx := b.messageAt(b.cursor)
+			if idx >= 0 && b.cursor == b.msgLines[idx] {
+				idx--
+			}
+			if idx >= 0 {
+				b.cursor = b.msgLines[idx]
+			}
+		}
+		if b.cursor >= len(b.buffer)/w {
+			b.cursor = len(b.buffer)/w - 1
+		}
+		if b.cursor < 0 {
+			b.cursor = 0
+		}
+		b.Draw()
+	case "resize":
+		b.refreshBuf()
+	case "toggle":
+		idx := b.messageAt(b.cursor)
+		if idx >= 0 {
+			b.setFolded(idx, !b.messages[idx].folded)
+		}
+		b.Draw()
+	case "foldall", "unfoldall":
+		idx := b.messageAt(b.cursor)
+		for i := range b.messages {
+			b.messages[i].folded = cmd == "foldall"
+		}
+		b.refreshBuf()
+		if idx >= 0 {
+			b.cursor = b.msgLines[idx]
+		}
+		b.Draw()
+	case "show":
+		idx := b.messageAt(b.cursor)
+		if idx < 0 {
+			break
+		}
+		if b.cursor == b.msgLines[idx] {
+			b.setFolded(idx, !b.messages[idx].folded)
+			b.Draw()
+			break
+		}
+		for i, l := range b.partLines[idx] {
+			if b.cursor == l {
+				openAttachment(&b.messages[idx].mail.Parts[i], b.tmpDir)
+				break
+			}
+		}
+	case "reply", "groupreply", "listreply":
+		idx := b.messageAt(b.cursor)
+		if idx < 0 || b.stillLoading() {
+			break
+		}
+		reply, err := composeReply(b.messages[idx].mail, replyModes[cmd])
+		if err != nil {
+			StatusLine = err.Error()
+			break
+		}
+		stack.Push(NewComposeBuffer(reply))
+	case "bounce":
+		idx := b.messageAt(b.cursor)
+		if idx < 0 {
+			break
+		}
+		bounceCmd(b.messages[idx].filename, args)
+	case "forward", "forwardattach":
+		idx := b.messageAt(b.cursor)
+		if idx < 0 || b.stillLoading() {
+			break
+		}
+		msg := &b.messages[idx]
+		fwd, err := composeForward(msg.mail, msg.filename, cmd == "forwardattach")
+		if err != nil {
+			StatusLine = err.Error()
+			break
+		}
+		stack.Push(NewComposeBuffer(fwd))
+	default:
+		return false
+	}
+	return true
+}
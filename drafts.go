@@ -0,0 +1,191 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/laochailan/barely/completion"
+	"github.com/laochailan/notmuch-go"
+	"github.com/paulrosania/go-charset/charset"
+)
+
+// DraftTag is the tag drafts are indexed with.
+const DraftTag = "draft"
+
+// saveDraft stores m in the draft-dir of the account matching its From address
+// and adds it to the notmuch database tagged as draft. If oldFile is not empty,
+// that earlier version of the draft is removed.
+//
+// It returns the filename of the new draft.
+func saveDraft(m *Mail, oldFile string) (string, error) {
+	account, err := fromAccount(m)
+	if err != nil {
+		return "", err
+	}
+	if account.Draft_Dir == "" {
+		return "", errors.New("No draft-dir configured for account.")
+	}
+
+	// encoding changes the headers, so keep the mail being edited intact.
+	mailcont, err := m.clone().Encode()
+	if err != nil {
+		return "", err
+	}
+
+	filename, err := addToMaildir(expandEnvHome(account.Draft_Dir), []byte(mailcont), "DS")
+	if err != nil {
+		return "", err
+	}
+
+	db, status := openWritable()
+	if status != notmuch.STATUS_SUCCESS {
+		return filename, errors.New(status.String())
+	}
+	defer closeWritable(db)
+
+	if oldFile != "" {
+		db.RemoveMessage(oldFile)
+		os.Remove(oldFile)
+	}
+
+	msg, status := db.AddMessage(filename)
+	if status != notmuch.STATUS_SUCCESS && status != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		return filename, errors.New(status.String())
+	}
+	defer msg.Destroy()
+
+	msg.Freeze()
+	msg.RemoveAllTags()
+	status = msg.AddTag(DraftTag)
+	if status == notmuch.STATUS_SUCCESS && len(m.Parts) > 1 {
+		status = msg.AddTag("attachment")
+	}
+	msg.Thaw()
+	if status != notmuch.STATUS_SUCCESS {
+		return filename, errors.New(status.String())
+	}
+	return filename, nil
+}
+
+// removeMailFile deletes a mail file, e.g. a draft, and removes it from the
+// notmuch database.
+func removeMailFile(filename string) error {
+	db, status := openWritable()
+	if status != notmuch.STATUS_SUCCESS {
+		return errors.New(status.String())
+	}
+	defer closeWritable(db)
+
+	status = db.RemoveMessage(filename)
+	if status != notmuch.STATUS_SUCCESS && status != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		return errors.New(status.String())
+	}
+	return os.Remove(filename)
+}
+
+// isDraft returns true if the mail m stored in filename is a draft, i.e. it
+// lies in the draft-dir or outbox-dir of an account or is tagged draft. Only
+// drafts are replaced when a resumed mail is saved or sent.
+func isDraft(filename string, m *Mail) bool {
+	filename = filepath.Clean(filename)
+	for _, account := range config.Account {
+		for _, dir := range []string{account.Draft_Dir, account.Outbox_Dir} {
+			if dir == "" {
+				continue
+			}
+			dir = filepath.Clean(expandEnvHome(dir)) + string(filepath.Separator)
+			if strings.HasPrefix(filename, dir) {
+				return true
+			}
+		}
+	}
+
+	db, status := notmuch.OpenDatabase(expandEnvHome(config.General.Database), 0)
+	if status != notmuch.STATUS_SUCCESS {
+		return false
+	}
+	defer db.Close()
+	msg, status := db.FindMessage(messageID(m.Header.Get("Message-ID")))
+	if status != notmuch.STATUS_SUCCESS || msg == nil {
+		return false
+	}
+	defer msg.Destroy()
+	return hasTag(msg, DraftTag) && filepath.Clean(msg.GetFileName()) == filename
+}
+
+// decodeAddressList decodes the names in a list of addresses. Names containing
+// commas or other special characters stay quoted, so that the list can be
+// parsed again.
+func decodeAddressList(dec *mime.WordDecoder, value string) (string, error) {
+	parser := mail.AddressParser{WordDecoder: dec}
+	list, err := parser.ParseList(value)
+	if err != nil {
+		return "", err
+	}
+	addrs := make([]string, len(list))
+	for i, addr := range list {
+		addrs[i] = (&completion.Address{Name: addr.Name, Addr: addr.Address}).String()
+	}
+	return strings.Join(addrs, ", "), nil
+}
+
+// loadDraft reads a draft so that it can be edited and sent again.
+//
+// readMail decodes the message for displaying, so headers and attachments
+// are converted back to the form composeMail and attachFile create.
+func loadDraft(filename string) (*Mail, error) {
+	m, err := readMail(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &mime.WordDecoder{CharsetReader: charset.NewReader}
+	for key, val := range m.Header {
+		for i := range val {
+			if addressFields[textproto.CanonicalMIMEHeaderKey(key)] {
+				if str, err := decodeAddressList(dec, val[i]); err == nil {
+					val[i] = str
+				}
+			} else if str, err := dec.DecodeHeader(val[i]); err == nil {
+				val[i] = str
+			}
+		}
+		m.Header[key] = val
+	}
+	// these are created again by Encode
+	delete(m.Header, "Content-Type")
+	delete(m.Header, "Content-Transfer-Encoding")
+
+	for i := range m.Parts {
+		p := &m.Parts[i]
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			p.Body, err = encodeBase64(strings.NewReader(p.Body))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// readParts converted plain text to utf-8 and the multipart reader
+		// removed the quoted-printable encoding.
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if strings.HasPrefix(contentType, "message/") {
+			continue // forwarded messages must not be encoded
+		}
+		if contentType == "text/plain" || contentType == "" {
+			p.Header.Set("Content-Type", "text/plain; charset=\"utf-8\"")
+		}
+		p.Header.Set("Content-Transfer-Encoding", "quoted-printable")
+	}
+
+	return m, nil
+}
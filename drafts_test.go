@@ -0,0 +1,63 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"testing"
+)
+
+func TestIsDraft(t *testing.T) {
+	oldAccounts, oldDatabase := config.Account, config.General.Database
+	config.Account = map[string]*Account{"a": {Addr: "me@example.com", Draft_Dir: "/home/me/mail/drafts/", Outbox_Dir: "/home/me/mail/outbox"}}
+	config.General.Database = "/nonexistent"
+	defer func() { config.Account, config.General.Database = oldAccounts, oldDatabase }()
+
+	m := &Mail{Header: mail.Header{"Message-Id": {"<abc@example.com>"}}}
+	for filename, expected := range map[string]bool{
+		"/home/me/mail/drafts/cur/123:2,DS":   true,
+		"/home/me/mail/drafts/../inbox/cur/1": false,
+		"/home/me/mail/drafts2/cur/1":         false,
+		"/home/me/mail/inbox/cur/1":           false,
+		"/home/me/mail/outbox/new/1":          true,
+	} {
+		if isDraft(filename, m) != expected {
+			t.Errorf("isDraft(%q) != %v", filename, expected)
+		}
+	}
+}
+
+func TestLoadDraft(t *testing.T) {
+	m := testMail()
+	m.Header["To"] = []string{"\"Müller, Hans\" <hans@example.com>, Jürgen <j@example.com>"}
+	m.Header["Subject"] = []string{"Grüße"}
+	encoded, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "barely-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(encoded)
+	file.Close()
+
+	draft, err := loadDraft(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"To":      "\"Müller, Hans\" <hans@example.com>, Jürgen <j@example.com>",
+		"From":    "Alice <alice@example.com>",
+		"Subject": "Grüße",
+	} {
+		if draft.Header.Get(key) != value {
+			t.Errorf("%s is %q, expected %q", key, draft.Header.Get(key), value)
+		}
+	}
+}
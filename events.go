@@ -0,0 +1,62 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	termbox "github.com/nsf/termbox-go"
+)
+
+// An appEvent is executed in the main loop. Goroutines use them to change the
+// state of the ui safely, e.g. to report the result of a long operation.
+type appEvent func(stack *BufferStack)
+
+// appEvents is the queue of events waiting to be executed by the main loop.
+var appEvents = make(chan appEvent, 16)
+
+// postEvent queues ev for execution in the main loop. It may be called from
+// any goroutine.
+func postEvent(ev appEvent) {
+	appEvents <- ev
+}
+
+// runAsync runs work in its own goroutine so that the ui does not block.
+// When work is finished, done is executed in the main loop with the error
+// returned by work.
+func runAsync(work func() error, done func(stack *BufferStack, err error)) {
+	go func() {
+		defer exitOnPanic()
+		err := work()
+		postEvent(func(stack *BufferStack) {
+			done(stack, err)
+		})
+	}()
+}
+
+// runMainLoop dispatches terminal and application events until all buffers
+// are closed.
+func runMainLoop(buffers *BufferStack) error {
+	termEvents := make(chan termbox.Event)
+	go func() {
+		for {
+			termEvents <- termbox.PollEvent()
+		}
+	}()
+
+	for len(buffers.buffers) > 0 {
+		err := termbox.Flush()
+		if err != nil {
+			return err
+		}
+		select {
+		case event := <-termEvents:
+			buffers.HandleEvent(&event)
+		case ev := <-appEvents:
+			ev(buffers)
+		case <-refreshEvents:
+			buffers.refresh()
+		}
+	}
+	return nil
+}
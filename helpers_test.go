@@ -0,0 +1,164 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// This file contains the fixtures shared by the tests of the package.
+
+// testMail returns a plain text mail from Alice to Bob.
+func testMail() *Mail {
+	m := composeMail()
+	m.Header["From"] = []string{"Alice <alice@example.com>"}
+	m.Header["To"] = []string{"Bob <bob@example.com>"}
+	m.Header["Subject"] = []string{"test"}
+	h := make(textproto.MIMEHeader)
+	h["Content-Type"] = []string{"text/plain; charset=\"utf-8\""}
+	h["Content-Transfer-Encoding"] = []string{"quoted-printable"}
+	m.Parts = []Part{{h, "Hello Bob,\nthis is signed. äöü\n"}}
+	return m
+}
+
+// readEncoded writes an encoded mail to a file and reads it with readMail.
+func readEncoded(t *testing.T, encoded string) *Mail {
+	file, err := ioutil.TempFile("", "barely-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(encoded)
+	file.Close()
+
+	m, err := readMail(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// gpg runs gpg in batch mode with the GNUPGHOME home and input on stdin and
+// returns its output.
+func gpg(t *testing.T, home, input string, args ...string) []byte {
+	cmd := exec.Command("gpg", append([]string{"--batch", "--passphrase", ""}, args...)...)
+	cmd.Env = append(os.Environ(), "GNUPGHOME="+home)
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.Output()
+	if err, ok := err.(*exec.ExitError); ok {
+		t.Fatal(string(err.Stderr))
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// newGnupgHome creates a throwaway GNUPGHOME with a signing key and an
+// encryption subkey for each of the given uids. It is removed when the test
+// ends.
+func newGnupgHome(t *testing.T, uids ...string) string {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not installed")
+	}
+	home, err := ioutil.TempDir("", "barely-gnupg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+		os.RemoveAll(home)
+	})
+
+	for _, uid := range uids {
+		gpg(t, home, "", "--quick-gen-key", uid, "ed25519", "sign", "never")
+		gpg(t, home, "", "--quick-add-key", fingerprint(t, home, uid), "cv25519", "encr", "never")
+	}
+	return home
+}
+
+// setupGnupgHome creates a GNUPGHOME with keys for uids and makes barely use
+// it. The returned function restores the environment.
+func setupGnupgHome(t *testing.T, uids ...string) func() {
+	home := newGnupgHome(t, uids...)
+	oldHome := os.Getenv("GNUPGHOME")
+	oldGpg := config.Commands.Gpg
+	os.Setenv("GNUPGHOME", home)
+	config.Commands.Gpg = "gpg"
+
+	return func() {
+		os.Setenv("GNUPGHOME", oldHome)
+		config.Commands.Gpg = oldGpg
+	}
+}
+
+// fingerprint returns the fingerprint of the primary key of uid in home.
+func fingerprint(t *testing.T, home, uid string) string {
+	out := gpg(t, home, "", "--with-colons", "--list-keys", uid)
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "fpr:") {
+			return strings.Split(line, ":")[9]
+		}
+	}
+	t.Fatal("no fingerprint for " + uid)
+	return ""
+}
+
+// setupSmime creates a throwaway CA and a certificate for alice@example.com
+// signed by it. It returns the account for alice; the returned function
+// restores the configuration.
+func setupSmime(t *testing.T) (*Account, func()) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl not installed")
+	}
+	dir, err := ioutil.TempDir("", "barely-smime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) {
+		cmd := exec.Command(openssl, args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(string(out))
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "ext"),
+		[]byte("subjectAltName=email:alice@example.com\nextendedKeyUsage=emailProtection\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run("req", "-x509", "-newkey", "rsa:2048", "-nodes", "-days", "1",
+		"-subj", "/CN=Test CA", "-keyout", "ca.key", "-out", "ca.crt")
+	run("req", "-newkey", "rsa:2048", "-nodes", "-subj", "/CN=Alice",
+		"-keyout", "alice.key", "-out", "alice.csr")
+	run("x509", "-req", "-in", "alice.csr", "-CA", "ca.crt", "-CAkey", "ca.key",
+		"-CAcreateserial", "-days", "1", "-extfile", "ext", "-out", "alice.crt")
+
+	account := &Account{
+		Addr:       "alice@example.com",
+		Smime_Cert: filepath.Join(dir, "alice.crt"),
+		Smime_Key:  filepath.Join(dir, "alice.key"),
+	}
+	oldOpenssl := config.Commands.Openssl
+	oldCa := config.General.Smime_Ca_File
+	oldAccounts := config.Account
+	config.Commands.Openssl = openssl
+	config.General.Smime_Ca_File = filepath.Join(dir, "ca.crt")
+	config.Account = map[string]*Account{"alice": account}
+
+	return account, func() {
+		config.Commands.Openssl = oldOpenssl
+		config.General.Smime_Ca_File = oldCa
+		config.Account = oldAccounts
+		os.RemoveAll(dir)
+	}
+}
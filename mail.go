@@ -38,14 +38,130 @@ type Part struct {
 	Body   string
 }
 
+// SignatureStatus is the result of verifying a signature.
+type SignatureStatus int
+
+const (
+	SigGood        SignatureStatus = iota // valid signature
+	SigBad                                // signature does not match or key is invalid
+	SigUnknownKey                         // key of the signer is not available
+	SigError                              // signature could not be checked
+	SigUntrusted                          // valid signature, but the key is not certified
+	SigWrongSender                        // valid signature by someone else than the sender
+)
+
+// Signature describes a signature found while reading a mail.
+type Signature struct {
+	Status SignatureStatus
+	Signer string // user id of the signer, or key id if it is unknown
+	Detail string // additional information, e.g. why verification failed
+
+	addrs []string // all addresses the key or certificate is valid for
+}
+
+// String returns a short description of the signature for displaying.
+func (s *Signature) String() string {
+	var str string
+	switch s.Status {
+	case SigGood:
+		str = "good signature"
+	case SigBad:
+		str = "BAD signature"
+	case SigUnknownKey:
+		str = "signature by unknown key " + s.Signer
+	case SigUntrusted, SigWrongSender:
+		str = "good signature"
+	default:
+		str = "signature could not be verified"
+	}
+	if s.Signer != "" && s.Status != SigUnknownKey && s.Status != SigError {
+		str += " from " + s.Signer
+	}
+	switch s.Status {
+	case SigUntrusted:
+		str += " with untrusted key"
+	case SigWrongSender:
+		str += ", who is NOT the sender"
+	}
+	if s.Detail != "" {
+		str += " (" + s.Detail + ")"
+	}
+	return str
+}
+
+// checkSender marks a valid signature that was not made by the address in the
+// From field of h.
+func (s *Signature) checkSender(h mail.Header) {
+	if s.Status != SigGood && s.Status != SigUntrusted {
+		return
+	}
+	from, err := mail.ParseAddress(h.Get("From"))
+	if err != nil {
+		s.Status = SigWrongSender
+		return
+	}
+	for _, addr := range s.addrs {
+		if strings.EqualFold(addr, from.Address) {
+			return
+		}
+	}
+	s.Status = SigWrongSender
+}
+
+// Security describes the cryptographic protection of a mail found while
+// reading it.
+type Security struct {
+	Encrypted  bool
+	Signatures []Signature
+	Errors     []string // e.g. failed decryption
+
+	// Partial is set if an inline signed or encrypted block is surrounded by
+	// text without protection.
+	Partial bool
+}
+
+// String returns a summary of the security status. It is empty for mails
+// without signatures or encryption.
+func (s *Security) String() string {
+	var items []string
+	if s.Encrypted {
+		items = append(items, "encrypted")
+	}
+	for i := range s.Signatures {
+		items = append(items, s.Signatures[i].String())
+	}
+	if s.Partial {
+		items = append(items, "only the marked part is protected")
+	}
+	items = append(items, s.Errors...)
+	return strings.Join(items, ", ")
+}
+
+// Bad returns true if a signature could not be verified, decryption failed or
+// only a part of the mail is protected.
+func (s *Security) Bad() bool {
+	for _, sig := range s.Signatures {
+		if sig.Status != SigGood {
+			return true
+		}
+	}
+	return len(s.Errors) > 0 || s.Partial
+}
+
 // Mail represents the content of one mail message.
 type Mail struct {
 	Header mail.Header
 	Parts  []Part
+
+	Security Security // only filled by readMail
 }
 
+// ForwardedHeader holds the message id of the mail forwarded by an unsent
+// mail, so that drafts and queued mail keep it. It is removed before sending.
+const ForwardedHeader = "X-Barely-Forwarded"
+
 // readParts read parts out of a multipart body (including nested multiparts).
-func readParts(reader io.Reader, boundary string, parts []Part) ([]Part, error) {
+func (m *Mail) readParts(reader io.Reader, boundary string) error {
 	mr := multipart.NewReader(reader, boundary)
 	for {
 		p, err := mr.NextPart()
@@ -53,33 +169,105 @@ func readParts(reader io.Reader, boundary string, parts []Part) ([]Part, error)
 			break
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		mediaType, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
-		if strings.HasPrefix(mediaType, "multipart/") {
-			parts, err = readParts(p, params["boundary"], parts)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			r := io.Reader(p)
-			if enc := p.Header.Get("Content-Transfer-Encoding"); enc == "base64" {
-				r = base64.NewDecoder(base64.StdEncoding, p)
-			}
+		err = m.readPart(p.Header, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			slurp, err := ioutil.ReadAll(r)
-			if err != nil {
-				return nil, err
+// readPart reads a single part. Multiparts are read recursively, signed and
+// encrypted ones are verified or decrypted first.
+func (m *Mail) readPart(header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch {
+	case mediaType == "multipart/signed" && params["protocol"] == "application/pgp-signature":
+		return m.readPgpSigned(body, params["boundary"])
+	case mediaType == "multipart/encrypted" && params["protocol"] == "application/pgp-encrypted":
+		return m.readPgpEncrypted(body, params["boundary"])
+	case mediaType == "multipart/signed" && (params["protocol"] == "application/pkcs7-signature" ||
+		params["protocol"] == "application/x-pkcs7-signature"):
+		return m.readSmimeSigned(body, params["boundary"])
+	case mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime":
+		return m.readSmime(header, body)
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return m.readParts(body, params["boundary"])
+	}
+
+	r := body
+	switch enc := header.Get("Content-Transfer-Encoding"); enc {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		// the multipart reader does this for parts it reads itself
+		r = quotedprintable.NewReader(body)
+		header.Del("Content-Transfer-Encoding")
+	}
+
+	slurp, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// parts without content type are plain text (RFC 2045)
+	if strings.HasPrefix(mediaType, "text/plain") || mediaType == "" {
+		slurp = convertToUtf8(slurp)
+		slurp = m.readInlinePgp(slurp)
+	}
+
+	m.Parts = append(m.Parts, Part{header, string(slurp)})
+	return nil
+}
+
+// splitMultipart splits a multipart body into its raw parts including their
+// headers. Unlike multipart.Reader, it leaves the content untouched so that
+// signatures can be checked.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delim := "--" + boundary
+	var parts [][]byte
+	start := -1 // start of the current part, -1 before the first delimiter
+	for pos := 0; pos < len(body); {
+		lineEnd := len(body)
+		if i := bytes.IndexByte(body[pos:], '\n'); i != -1 {
+			lineEnd = pos + i + 1
+		}
+		line := strings.TrimRight(string(body[pos:lineEnd]), " \t\r\n")
+		if line == delim || line == delim+"--" {
+			if start != -1 {
+				// the line break before the delimiter belongs to it (RFC 2046)
+				end := pos
+				if end > start && body[end-1] == '\n' {
+					end--
+				}
+				if end > start && body[end-1] == '\r' {
+					end--
+				}
+				parts = append(parts, body[start:end])
 			}
-			if strings.HasPrefix(mediaType, "text/plain") {
-				slurp = convertToUtf8(slurp)
+			if line == delim+"--" {
+				break
 			}
-
-			parts = append(parts, Part{p.Header, string(slurp)})
+			start = lineEnd
 		}
+		pos = lineEnd
+	}
+	return parts
+}
+
+// parseEntity splits a raw MIME entity into header and body.
+func parseEntity(raw []byte) (textproto.MIMEHeader, io.Reader, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, nil, err
 	}
-	return parts, nil
+	if header == nil {
+		header = make(textproto.MIMEHeader)
+	}
+	return header, r.R, nil
 }
 
 // convertToUtf8 detects the charset of the given plain text slice and converts it to utf-8
@@ -130,11 +318,8 @@ func readMail(filename string) (*Mail, error) {
 		params["charset"] = "utf-8"
 	}
 
-	var bodyReader io.Reader
-	var boundary string
 	if strings.HasPrefix(mediaType, "multipart/") {
-		bodyReader = msg.Body
-		boundary = params["boundary"]
+		err = m.readPart(textproto.MIMEHeader(msg.Header), msg.Body)
 	} else {
 		// convert to multipart
 		const boundaryText = "uaedt3rnc5trnu0aio94rane"
@@ -145,12 +330,12 @@ func readMail(filename string) (*Mail, error) {
 		io.Copy(buf, msg.Body)
 		buf.WriteString("\r\n--" + boundaryText + "--\r\n")
 
-		bodyReader = buf
-		boundary = boundaryText
+		err = m.readParts(buf, boundaryText)
 	}
 
-	m.Parts, err = readParts(bodyReader, boundary, m.Parts)
-
+	for i := range m.Security.Signatures {
+		m.Security.Signatures[i].checkSender(m.Header)
+	}
 	return m, err
 }
 
@@ -162,63 +347,301 @@ func composeMail() *Mail {
 	m.Header["MIME-Version"] = []string{"1.0"}
 	m.Header["User-Agent"] = []string{UserAgent}
 
+	m.Header["Message-ID"] = []string{newMessageID()}
+	m.Header["Date"] = []string{time.Now().Format(time.RFC1123Z)}
+	return m
+}
+
+// composeNew creates a Mail structure for a new mail from the default
+// account, including its signature.
+func composeNew() (*Mail, error) {
+	m := composeMail()
+	account := defaultAccount()
+	if account == nil {
+		return m, nil
+	}
+	m.Header["From"] = []string{account.Addr}
+
+	signature, err := signatureText(account)
+	if err != nil {
+		return m, err
+	}
+	if signature != "" {
+		partHeader := make(textproto.MIMEHeader)
+		partHeader["Content-Type"] = []string{"text/plain; charset=\"utf-8\""}
+		partHeader["Content-Transfer-Encoding"] = []string{"quoted-printable"}
+		m.Parts = []Part{{partHeader, "\n" + signature}}
+	}
+	return m, nil
+}
+
+// newMessageID creates a unique message id.
+func newMessageID() string {
 	t := time.Now()
 	hostname, _ := os.Hostname()
-	messageid := fmt.Sprintf("<%d%d%d%d%d.%x%x.%x@%s>", t.Year(), t.Month(),
+	return fmt.Sprintf("<%d%d%d%d%d.%x%x.%x@%s>", t.Year(), t.Month(),
 		t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Unix(), hostname)
-	m.Header["Message-ID"] = []string{messageid}
-	m.Header["Date"] = []string{time.Now().Format(time.RFC1123Z)}
-	return m
 }
 
-// chooseReplyToFrom chooses the To and From fields of the reply based on the fields of the mail replied to
-func chooseReplyToFrom(origTo, origFrom string, groupReply bool) (to, from string) {
-	fromAddr, err := mail.ParseAddressList(origFrom)
+// replyMode selects the recipients of a reply.
+type replyMode int
+
+const (
+	replySender replyMode = iota // reply to the author only
+	replyGroup                   // reply to the author and all recipients
+	replyList                    // reply to the mailing list
+)
+
+// replyModes maps the reply commands to their modes.
+var replyModes = map[string]replyMode{
+	"reply":      replySender,
+	"groupreply": replyGroup,
+	"listreply":  replyList,
+}
+
+// headerAddresses parses the address list in header field key of h. Invalid
+// fields are treated as empty.
+func headerAddresses(h mail.Header, key string) []*mail.Address {
+	list, err := h.AddressList(key)
 	if err != nil {
-		return origFrom, origTo
+		return nil
 	}
-	toAddr, err := mail.ParseAddressList(origTo)
+	return list
+}
+
+// isOwnAddress returns true if addr belongs to one of the accounts.
+func isOwnAddress(addr string) bool {
+	for _, account := range config.Account {
+		if strings.EqualFold(addr, account.Addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownAddress returns the first recipient of a mail with header h that belongs
+// to one of the accounts, or an empty string.
+func ownAddress(h mail.Header) string {
+	for _, key := range []string{"To", "Cc"} {
+		for _, addr := range headerAddresses(h, key) {
+			if isOwnAddress(addr.Address) {
+				return addr.String()
+			}
+		}
+	}
+	return ""
+}
+
+// defaultAccount returns the first account ordered by name, or nil if there is
+// none.
+func defaultAccount() *Account {
+	var names []string
+	for name := range config.Account {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return config.Account[names[0]]
+}
+
+// accountFor returns the account of the address in from, or nil if from is no
+// address of an account.
+func accountFor(from string) *Account {
+	addr, err := mail.ParseAddress(from)
 	if err != nil {
-		return origFrom, origTo
+		return nil
+	}
+	return getAccount(addr.Address)
+}
+
+// signatureText returns the signature of account including the "-- "
+// separator line. It is printed by the signature-command or read from the
+// signature file. Without a signature, the result is empty.
+func signatureText(account *Account) (string, error) {
+	if account == nil {
+		return "", nil
+	}
+
+	var sig []byte
+	var err error
+	switch {
+	case account.Signature_Command != "":
+		strcmd := strings.Split(account.Signature_Command, " ")
+		sig, err = exec.Command(strcmd[0], strcmd[1:]...).Output()
+		if err != nil {
+			return "", fmt.Errorf("signature-command failed: %s", err)
+		}
+	case account.Signature != "":
+		sig, err = ioutil.ReadFile(expandEnvHome(account.Signature))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	text := strings.TrimRight(string(sig), "\r\n")
+	if text == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(text, "-- \n") {
+		text = "-- \n" + text
+	}
+	return text + "\n", nil
+}
+
+// Templates used if the account does not set reply-attribution or
+// forward-header.
+const (
+	defaultReplyAttribution = "Quoting %name (%date):"
+	defaultForwardHeader    = "---------- Forwarded message ----------"
+)
+
+// expandTemplate replaces the fields %name, %addr, %date and %subject in tmpl
+// with the values of the author, date and subject of m. %% is a literal %.
+func expandTemplate(tmpl string, m *Mail) string {
+	addr, err := m.Header.AddressList("From")
+	name, address := "", ""
+	if len(addr) != 0 {
+		name = addr[0].Name
+		address = addr[0].Address
+	}
+	if name == "" || err != nil {
+		name = m.Header.Get("From")
+	}
+	date, _ := m.Header.Date()
+
+	return strings.NewReplacer(
+		"%%", "%",
+		"%name", name,
+		"%addr", address,
+		"%date", date.Format("2006-01-02 15:04"),
+		"%subject", decodeHeader(m, "Subject"),
+	).Replace(tmpl)
+}
+
+// listPostAddress returns the address to post to a mailing list out of the
+// List-Post header field (RFC 2369), e.g. "<mailto:list@example.com>".
+func listPostAddress(h mail.Header) (string, error) {
+	listPost := strings.TrimSpace(h.Get("List-Post"))
+	if listPost == "" {
+		return "", errors.New("No List-Post header. Not a mailing list message?")
+	}
+	for _, url := range strings.Split(listPost, ",") {
+		url = strings.Trim(strings.TrimSpace(url), "<>")
+		if strings.HasPrefix(strings.ToLower(url), "mailto:") {
+			addr := url[len("mailto:"):]
+			if i := strings.Index(addr, "?"); i != -1 {
+				addr = addr[:i]
+			}
+			return addr, nil
+		}
+	}
+	return "", errors.New("Posting to this mailing list is not allowed.")
+}
+
+// chooseReplyRecipients chooses the To, Cc and From fields of a reply to a
+// mail with header h.
+//
+// Replies to the sender go to Mail-Reply-To, Reply-To or From, in that order of
+// preference. Group replies go to Mail-Followup-To if set, otherwise to
+// Reply-To or From and the original To, with the original Cc kept in Cc.
+// Own addresses are left out of group replies. List replies go to the address
+// from List-Post.
+func chooseReplyRecipients(h mail.Header, mode replyMode) (to, cc []*mail.Address, from string, err error) {
+	origTo := headerAddresses(h, "To")
+	origCc := headerAddresses(h, "Cc")
+
+	from = ownAddress(h)
+	if from == "" {
+		from = h.Get("To")
+		if len(origTo) > 0 {
+			from = origTo[0].String()
+		}
 	}
 
-	from = origTo
+	author := headerAddresses(h, "Reply-To")
+	if len(author) == 0 {
+		author = headerAddresses(h, "From")
+	}
 
-	// find an address that can be sent from
-outer:
-	for i, addr := range toAddr {
-		for _, account := range config.Account {
-			if addr.Address == account.Addr {
-				from = addr.String()
-				if groupReply {
-					fromAddr = append(fromAddr, toAddr[:i]...)
-					fromAddr = append(fromAddr, toAddr[i+1:]...)
-					StatusLine = fmt.Sprintf("%d", len(fromAddr))
+	switch mode {
+	case replySender:
+		to = headerAddresses(h, "Mail-Reply-To")
+		if len(to) == 0 {
+			to = author
+		}
+		// replying to an own mail continues the conversation with its recipients
+		if len(to) == 1 && isOwnAddress(to[0].Address) && len(origTo) > 0 {
+			to = origTo
+		}
+	case replyGroup:
+		if followup := headerAddresses(h, "Mail-Followup-To"); len(followup) > 0 {
+			to = followup
+		} else {
+			to = append(append(to, author...), origTo...)
+			cc = origCc
+		}
+	case replyList:
+		addr, err := listPostAddress(h)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		to = []*mail.Address{{Address: addr}}
+	}
+
+	if mode == replyGroup {
+		// remove duplicates and own addresses, unless nothing is left
+		seen := make(map[string]bool)
+		filter := func(list []*mail.Address) []*mail.Address {
+			var filtered []*mail.Address
+			for _, addr := range list {
+				key := strings.ToLower(addr.Address)
+				if !seen[key] && !isOwnAddress(addr.Address) {
+					filtered = append(filtered, addr)
 				}
-				break outer
+				seen[key] = true
 			}
+			return filtered
+		}
+		if filteredTo := filter(to); len(filteredTo) > 0 {
+			to = filteredTo
 		}
+		cc = filter(cc)
 	}
+	return to, cc, from, nil
+}
 
-	strList := make([]string, len(fromAddr))
-	for i, a := range fromAddr {
+// joinAddresses formats an address list for a header field.
+func joinAddresses(list []*mail.Address) string {
+	strList := make([]string, len(list))
+	for i, a := range list {
 		strList[i] = a.String()
 	}
-
-	to = strings.Join(strList, ", ")
-	return to, from
+	return strings.Join(strList, ", ")
 }
 
-// composeReply creates a Mail structure for a Reply to Mail m.
-func composeReply(m *Mail, groupReply bool) *Mail {
+// composeReply creates a Mail structure for a Reply to Mail m. mode selects
+// the recipients.
+func composeReply(m *Mail, mode replyMode) (*Mail, error) {
+	to, cc, from, err := chooseReplyRecipients(m.Header, mode)
+	if err != nil {
+		return nil, err
+	}
+
 	reply := composeMail()
 
 	dec := new(mime.WordDecoder)
 
-	oldFrom := m.Header.Get("From")
-	oldTo := m.Header.Get("To")
-	to, from := chooseReplyToFrom(oldTo, oldFrom, groupReply)
-	reply.Header["To"], reply.Header["From"] = []string{to}, []string{from}
+	if len(to) > 0 {
+		reply.Header["To"] = []string{joinAddresses(to)}
+	} else {
+		reply.Header["To"] = []string{m.Header.Get("From")}
+	}
+	if len(cc) > 0 {
+		reply.Header["Cc"] = []string{joinAddresses(cc)}
+	}
+	reply.Header["From"] = []string{from}
 	reply.Header["In-Reply-To"] = []string{m.Header.Get("Message-ID")}
 
 	refs := m.Header["References"]
@@ -241,20 +664,18 @@ func composeReply(m *Mail, groupReply bool) *Mail {
 
 	reply.Header["Subject"] = []string{subj}
 
-	var replyBuf bytes.Buffer
-
-	addr, err := m.Header.AddressList("From")
-	name := ""
-	if len(addr) != 0 {
-		name = addr[0].Name
+	account := accountFor(from)
+	signature, err := signatureText(account)
+	if err != nil {
+		return nil, err
 	}
-	if name == "" || err != nil {
-		name = m.Header.Get("From")
+	attribution := defaultReplyAttribution
+	if account != nil && account.Reply_Attribution != "" {
+		attribution = account.Reply_Attribution
 	}
-	date, _ := m.Header.Date()
-	datestr := date.Format("2006-01-02 15:04")
 
-	replyBuf.WriteString(fmt.Sprintf("Quoting %s (%s):\n", name, datestr))
+	var replyBuf bytes.Buffer
+	replyBuf.WriteString(expandTemplate(attribution, m) + "\n")
 	for _, p := range m.Parts {
 		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
 		if contentType == "text/plain" {
@@ -266,12 +687,144 @@ func composeReply(m *Mail, groupReply bool) *Mail {
 		}
 	}
 
+	if signature != "" {
+		replyBuf.WriteString("\n" + signature)
+	}
+
 	partHeader := make(textproto.MIMEHeader)
 	partHeader["Content-Type"] = []string{"text/plain; charset=\"utf-8\""}
 	partHeader["Content-Transfer-Encoding"] = []string{"quoted-printable"}
 	reply.Parts = []Part{{partHeader, replyBuf.String()}}
 
-	return reply
+	return reply, nil
+}
+
+// attachmentCopy returns a copy of part p of a mail read by readMail that can
+// be attached to a new mail.
+func attachmentCopy(p *Part) (Part, error) {
+	header := make(textproto.MIMEHeader, len(p.Header))
+	for key, val := range p.Header {
+		header[key] = append([]string(nil), val...)
+	}
+	// readParts converted plain text to utf-8
+	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil && contentType == "text/plain" {
+		params["charset"] = "utf-8"
+		header.Set("Content-Type", mime.FormatMediaType(contentType, params))
+	}
+	if header.Get("Content-Disposition") == "" {
+		header.Set("Content-Disposition", "attachment")
+	}
+
+	body, err := encodeBase64(strings.NewReader(p.Body))
+	if err != nil {
+		return Part{}, err
+	}
+	header.Set("Content-Transfer-Encoding", "base64")
+	return Part{header, body}, nil
+}
+
+// composeForward creates a Mail structure forwarding Mail m read from filename.
+// If attach is true, the original message is attached as message/rfc822.
+// Otherwise its text is included in the body and its attachments are copied.
+func composeForward(m *Mail, filename string, attach bool) (*Mail, error) {
+	fwd := composeMail()
+
+	from := ownAddress(m.Header)
+	if account := defaultAccount(); from == "" && account != nil {
+		from = account.Addr
+	}
+	fwd.Header["From"] = []string{from}
+
+	account := accountFor(from)
+	signature, err := signatureText(account)
+	if err != nil {
+		return nil, err
+	}
+	if signature != "" {
+		signature = "\n" + signature
+	}
+
+	subj := decodeHeader(m, "Subject")
+	if lower := strings.ToLower(subj); !strings.HasPrefix(lower, "fwd:") &&
+		!strings.HasPrefix(lower, "fw:") {
+		subj = "Fwd: " + subj
+	}
+	fwd.Header["Subject"] = []string{subj}
+	fwd.Header[ForwardedHeader] = []string{m.Header.Get("Message-Id")}
+
+	partHeader := make(textproto.MIMEHeader)
+	partHeader["Content-Type"] = []string{"text/plain; charset=\"utf-8\""}
+	partHeader["Content-Transfer-Encoding"] = []string{"quoted-printable"}
+
+	if attach {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		header := make(textproto.MIMEHeader)
+		header["Content-Type"] = []string{"message/rfc822"}
+		header["Content-Disposition"] = []string{"inline"}
+		header["Content-Transfer-Encoding"] = []string{"7bit"}
+		for _, c := range content {
+			if c >= 0x80 {
+				header["Content-Transfer-Encoding"] = []string{"8bit"}
+				break
+			}
+		}
+		fwd.Parts = []Part{{partHeader, signature}, {header, canonicalCRLF(string(content))}}
+		return fwd, nil
+	}
+
+	forwardHeader := defaultForwardHeader
+	if account != nil && account.Forward_Header != "" {
+		forwardHeader = account.Forward_Header
+	}
+
+	var fwdBuf bytes.Buffer
+	fwdBuf.WriteString(signature + "\n" + expandTemplate(forwardHeader, m) + "\n")
+	for _, key := range []string{"From", "Date", "Subject", "To", "Cc"} {
+		if value := decodeHeader(m, key); value != "" {
+			fwdBuf.WriteString(key + ": " + value + "\n")
+		}
+	}
+	fwdBuf.WriteString("\n")
+
+	// parts without content type are plain text
+	isText := func(p *Part) bool {
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		return (contentType == "text/plain" || contentType == "") && attachmentName(p) == ""
+	}
+	hasText := false
+	for i := range m.Parts {
+		hasText = hasText || isText(&m.Parts[i])
+	}
+
+	var attachments []Part
+	for i := range m.Parts {
+		p := &m.Parts[i]
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		name := attachmentName(p)
+		switch {
+		case isText(p):
+			fwdBuf.WriteString(p.Body)
+			if !strings.HasSuffix(p.Body, "\n") {
+				fwdBuf.WriteString("\n")
+			}
+		case contentType == "text/html" && name == "" && hasText:
+			// alternative version of the text
+		default:
+			part, err := attachmentCopy(p)
+			if err != nil {
+				return nil, err
+			}
+			attachments = append(attachments, part)
+		}
+	}
+	fwdBuf.WriteString("---------- End forwarded message ----------\n")
+
+	fwd.Parts = append([]Part{{partHeader, fwdBuf.String()}}, attachments...)
+	return fwd, nil
 }
 
 // randomBoundary creates a boundary to be used for multipart e-mail bodies.
@@ -285,21 +838,31 @@ func randomBoundary() string {
 	return fmt.Sprintf("%x", buf[:])
 }
 
+// encodeBase64 encodes the content of r to base64 with lines of 76 characters.
+func encodeBase64(r io.Reader) (string, error) {
+	var buf bytes.Buffer
+	nlInsert := newNewlineInserter(&buf, 76)
+	enc := base64.NewEncoder(base64.StdEncoding, nlInsert)
+	_, err := io.Copy(enc, r)
+	if err != nil {
+		return "", err
+	}
+	enc.Close()
+	return buf.String(), nil
+}
+
 // attachMail adds a file as an attachment to the mail.
 func (m *Mail) attachFile(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	var buf bytes.Buffer
-	nlInsert := newNewlineInserter(&buf, 76)
-	enc := base64.NewEncoder(base64.StdEncoding, nlInsert)
-	_, err = io.Copy(enc, file)
+	body, err := encodeBase64(file)
 	if err != nil {
 		return err
 	}
-	enc.Close()
 	typ := mime.TypeByExtension(filepath.Ext(filename))
 	name := filepath.Base(filename)
 	if typ == "" {
@@ -310,87 +873,155 @@ func (m *Mail) attachFile(filename string) error {
 	header["Content-Type"] = []string{typ + "; name=\"" + name + "\""}
 	header["Content-Disposition"] = []string{"attachment; filename=\"" + name + "\""}
 	header["Content-Transfer-Encoding"] = []string{"base64"}
-	m.Parts = append(m.Parts, Part{header, buf.String()})
+	m.Parts = append(m.Parts, Part{header, body})
 
 	return nil
 }
 
-// Encode encodes a Mail structure to 7bit text.
-func (m *Mail) Encode() (string, error) {
+// clone returns a deep copy of the mail. Use it to keep the original intact
+// when encoding.
+func (m *Mail) clone() *Mail {
+	c := new(Mail)
+	c.Header = make(mail.Header, len(m.Header))
+	for key, val := range m.Header {
+		c.Header[key] = append([]string(nil), val...)
+	}
+	c.Parts = make([]Part, len(m.Parts))
+	for i, p := range m.Parts {
+		h := make(textproto.MIMEHeader, len(p.Header))
+		for key, val := range p.Header {
+			h[key] = append([]string(nil), val...)
+		}
+		c.Parts[i] = Part{h, p.Body}
+	}
+	return c
+}
+
+// encodeContent encodes the parts of the mail to a single MIME entity. It returns the
+// content headers of the entity and its 7bit body.
+func (m *Mail) encodeContent() (textproto.MIMEHeader, string, error) {
 	if len(m.Parts) == 0 {
-		return "", errors.New("Error: message without content")
+		return nil, "", errors.New("Error: message without content")
 	}
 
-	boundary := randomBoundary()
+	var buffer bytes.Buffer
+	header := make(textproto.MIMEHeader)
 
 	if len(m.Parts) == 1 {
 		for key, val := range m.Parts[0].Header {
-			m.Header[key] = val
+			header[key] = val
 		}
-	} else {
-		m.Header["Content-Type"] = []string{"multipart/mixed; boundary=" + boundary}
+		writer := quotedprintable.NewWriter(&buffer)
+		_, err := writer.Write([]byte(m.Parts[0].Body))
+		if err != nil {
+			return nil, "", err
+		}
+		writer.Close()
+		return header, buffer.String(), nil
 	}
 
-	var buffer bytes.Buffer
-	headers := make([]string, 0, len(m.Header))
+	boundary := randomBoundary()
+	header["Content-Type"] = []string{"multipart/mixed; boundary=" + boundary}
+	mpw := multipart.NewWriter(&buffer)
+	mpw.SetBoundary(boundary)
+	for _, p := range m.Parts {
+		pw, err := mpw.CreatePart(p.Header)
+		if err != nil {
+			return nil, "", err
+		}
+		if p.Header.Get("Content-Transfer-Encoding") == "quoted-printable" {
+			writer := quotedprintable.NewWriter(pw)
+			writer.Write([]byte(p.Body))
+			writer.Close()
+		} else {
+			pw.Write([]byte(p.Body))
+		}
+	}
+	mpw.Close()
+	return header, buffer.String(), nil
+}
 
-	for key, val := range m.Header {
-		for i := range val {
-			if val[i] == "" {
+// addressFields are the header fields containing address lists.
+var addressFields = map[string]bool{
+	"From":             true,
+	"Sender":           true,
+	"To":               true,
+	"Cc":               true,
+	"Bcc":              true,
+	"Reply-To":         true,
+	"Mail-Followup-To": true,
+	"Resent-From":      true,
+	"Resent-To":        true,
+	"Resent-Cc":        true,
+	"Resent-Bcc":       true,
+}
+
+// encodeAddressList encodes the names in a list of addresses. The addresses
+// themselves stay readable.
+func encodeAddressList(value string) (string, error) {
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return "", err
+	}
+	addrs := make([]string, len(list))
+	for i, addr := range list {
+		addrs[i] = addr.Address
+		if addr.Name != "" {
+			addrs[i] = addr.String()
+		}
+	}
+	return strings.Join(addrs, ", "), nil
+}
+
+// writeHeader writes a mail header in sorted order to buffer. Non-ascii values
+// are encoded.
+func writeHeader(buffer *bytes.Buffer, header mail.Header) {
+	headers := make([]string, 0, len(header))
+
+	for key, val := range header {
+		encoded := make([]string, 0, len(val))
+		for _, v := range val {
+			if v == "" {
 				continue
 			}
 
-			if key == "From" || key == "To" { // don't encode mail addresses.
-				split := strings.Split(val[i], " ")
-				val[i] = mime.QEncoding.Encode("utf-8", strings.Join(split[:len(split)-1], " ")) + " " + split[len(split)-1]
-			} else {
-				val[i] = mime.QEncoding.Encode("utf-8", val[i])
+			if addressFields[textproto.CanonicalMIMEHeaderKey(key)] {
+				if list, err := encodeAddressList(v); err == nil {
+					encoded = append(encoded, list)
+					continue
+				}
 			}
+			encoded = append(encoded, mime.QEncoding.Encode("utf-8", v))
 		}
 
-		s := strings.Join(val, " ")
+		s := strings.Join(encoded, " ")
 		headers = append(headers, key+": "+s+"\r\n")
 	}
 	sort.Strings(headers)
 	for _, s := range headers {
-		_, err := buffer.WriteString(s)
-		if err != nil {
-			return "", err
-		}
+		buffer.WriteString(s)
 	}
-	_, err := buffer.WriteString("\r\n")
+}
+
+// Encode encodes a Mail structure to 7bit text.
+func (m *Mail) Encode() (string, error) {
+	header, body, err := m.encodeContent()
 	if err != nil {
 		return "", err
 	}
-
-	if len(m.Parts) == 1 {
-		writer := quotedprintable.NewWriter(&buffer)
-		defer writer.Close()
-		_, err := writer.Write([]byte(m.Parts[0].Body))
-		if err != nil {
-			return "", err
-		}
-	} else {
-		mpw := multipart.NewWriter(&buffer)
-		mpw.SetBoundary(boundary)
-		for _, p := range m.Parts {
-			pw, err := mpw.CreatePart(p.Header)
-			if err != nil {
-				return "", err
-			}
-			writer := pw
-			if p.Header.Get("Content-Transfer-Encoding") == "quoted-printable" {
-				writer = quotedprintable.NewWriter(pw)
-			}
-
-			writer.Write([]byte(p.Body))
-		}
-		mpw.Close()
+	for key, val := range header {
+		m.Header[key] = val
 	}
-	return buffer.String(), err
+
+	var buffer bytes.Buffer
+	writeHeader(&buffer, m.Header)
+	buffer.WriteString("\r\n")
+	buffer.WriteString(body)
+	return buffer.String(), nil
 }
 
-func addToMaildir(maildirPath string, content []byte) (filename string, err error) {
+// addToMaildir stores content as a new message with the given maildir flags.
+func addToMaildir(maildirPath string, content []byte, flags string) (filename string, err error) {
 	md, err := maildir.Open(maildirPath, true)
 	if err != nil {
 		return
@@ -400,7 +1031,7 @@ func addToMaildir(maildirPath string, content []byte) (filename string, err erro
 	if err != nil {
 		return
 	}
-	err = msg.SetFlags("S")
+	err = msg.SetFlags(flags)
 	if err != nil {
 		return
 	}
@@ -409,79 +1040,282 @@ func addToMaildir(maildirPath string, content []byte) (filename string, err erro
 	return
 }
 
-func sendMail(m *Mail) error {
+// fromAccount returns the account matching the From address of m.
+func fromAccount(m *Mail) (*Account, error) {
 	addrl, err := m.Header.AddressList("From")
-	if len(addrl) != 1 {
-		return errors.New("Invalid count of addresses in 'From' field.")
+	if err != nil || len(addrl) != 1 {
+		return nil, errors.New("Invalid count of addresses in 'From' field.")
 	}
 
 	addr := addrl[0]
 
 	account := getAccount(addr.Address)
 	if account == nil {
-		return fmt.Errorf("No account configured for '%s'", addr.Address)
+		return nil, fmt.Errorf("No account configured for '%s'", addr.Address)
 	}
+	return account, nil
+}
 
-	switch {
-	case account.Sent_Dir == "":
-		return errors.New("No sent-dir configured for account.")
-	case account.Sendmail_Command == "":
-		return errors.New("No sendmail-command configured for account.")
+// addresses parses the address list header fields keys of m and returns
+// all addresses in them.
+func (m *Mail) addresses(keys ...string) ([]string, error) {
+	var addrs []string
+	for _, key := range keys {
+		for _, value := range m.Header[textproto.CanonicalMIMEHeaderKey(key)] {
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid '%s' field: %s", key, err)
+			}
+			for _, a := range list {
+				addrs = append(addrs, a.Address)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// stripHeader removes all header fields key from the encoded mail content.
+func stripHeader(content, key string) string {
+	end := strings.Index(content, "\r\n\r\n")
+	if end == -1 {
+		return content
+	}
+	var header bytes.Buffer
+	stripping := false
+	for _, line := range strings.SplitAfter(content[:end+2], "\r\n") {
+		if line == "" {
+			continue
+		}
+		// continuation lines belong to the previous field
+		if line[0] != ' ' && line[0] != '\t' {
+			name := strings.SplitN(line, ":", 2)[0]
+			stripping = strings.EqualFold(strings.TrimSpace(name), key)
+		}
+		if !stripping {
+			header.WriteString(line)
+		}
 	}
+	return header.String() + content[end+2:]
+}
 
-	mailcont, err := m.Encode()
+// cryptoOptions select how outgoing mail is protected.
+type cryptoOptions struct {
+	sign    bool // PGP/MIME signature
+	encrypt bool // PGP/MIME encryption for all recipients
+	smime   bool // S/MIME signature
+}
+
+// sendMail encodes m as selected by opts, sends it and stores it in the sent-dir
+// of its account. If sending fails for a reason that may go away and the
+// account has an outbox-dir, the mail is queued there and a *queuedError is
+// returned. Warnings of the sendmail-command are returned as well.
+func sendMail(m *Mail, opts cryptoOptions) (string, error) {
+	account, mailcont, err := prepareMail(m, opts)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if account.Sent_Dir == "" {
+		return "", errors.New("No sent-dir configured for account.")
+	}
+
+	warning, err := deliverMail(account, mailcont)
+	if err != nil {
+		if account.Outbox_Dir == "" || !retryable(err) {
+			return "", err
+		}
+		_, qerr := indexMail(account.Outbox_Dir, "", []byte(mailcont), queuedTags(m))
+		if qerr != nil {
+			return "", fmt.Errorf("%s. Could not queue mail: %s", err, qerr)
+		}
+		return "", &queuedError{err}
+	}
+
+	_, err = indexMail(account.Sent_Dir, "S", []byte(stripHeader(mailcont, ForwardedHeader)),
+		sentTags(account, len(m.Parts) > 1))
+	return warning, err
+}
+
+// messageID returns the message id in a Message-ID or In-Reply-To field
+// without angle brackets, as notmuch uses it.
+func messageID(field string) string {
+	field = strings.TrimSpace(field)
+	if start := strings.Index(field, "<"); start != -1 {
+		if end := strings.Index(field[start:], ">"); end != -1 {
+			return field[start+1 : start+end]
+		}
+	}
+	return field
+}
+
+// tagOriginals tags the messages that the sent mails with the headers hs
+// replied to as replied, and those they forwarded as passed. Maildir flags
+// are synchronized if configured.
+func tagOriginals(hs ...mail.Header) error {
+	var changes []tagChange
+	for _, h := range hs {
+		if id := messageID(h.Get("In-Reply-To")); id != "" {
+			changes = append(changes, tagChange{id, []string{"replied"}, nil})
+		}
+		if id := messageID(h.Get(ForwardedHeader)); id != "" {
+			changes = append(changes, tagChange{id, []string{"passed"}, nil})
+		}
+	}
+	if len(changes) == 0 {
+		return nil
 	}
+	return applyTagChanges(changes, false)
+}
+
+// prepareMail checks that m can be sent and encodes it as selected by opts.
+func prepareMail(m *Mail, opts cryptoOptions) (*Account, string, error) {
+	account, err := fromAccount(m)
+	if err != nil {
+		return nil, "", err
+	}
+	if account.Sendmail_Command == "" && account.Smtp_Host == "" {
+		return nil, "", errors.New("No sendmail-command or smtp-host configured for account.")
+	}
+
+	recipients, err := m.addresses("To", "Cc", "Bcc")
+	if err != nil {
+		return nil, "", err
+	}
+	if len(recipients) == 0 {
+		return nil, "", errors.New("No recipients.")
+	}
+
+	var mailcont string
+	if opts.smime {
+		mailcont, err = m.encodeSmimeSigned(account)
+	} else if opts.encrypt {
+		mailcont, err = m.encodeEncrypted(account, opts.sign)
+	} else if opts.sign {
+		mailcont, err = m.encodeSigned(account.Pgp_Key)
+	} else {
+		mailcont, err = m.Encode()
+	}
+	return account, mailcont, err
+}
 
+// deliverMail hands the encoded mail content to the SMTP server or the
+// sendmail-command of account. The recipients are taken from the To, Cc and
+// Bcc fields of content. Warnings printed by the sendmail-command are
+// returned.
+func deliverMail(account *Account, mailcont string) (string, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(mailcont))
+	if err != nil {
+		return "", err
+	}
+	m := &Mail{Header: msg.Header}
+	recipients, err := m.addresses("To", "Cc", "Bcc")
+	if err != nil {
+		return "", err
+	}
+
+	// Bcc recipients are only given in the envelope so that they do not
+	// show up in the mail. The sent copy keeps the field.
+	mailcont = stripHeader(stripHeader(mailcont, "Bcc"), ForwardedHeader)
+	if account.Smtp_Host != "" {
+		return "", smtpSend(account, recipients, mailcont)
+	}
+
+	program, args := sendmailCommand(account, recipients)
+	return runSendmail(program, args, strings.NewReader(mailcont))
+}
+
+// sendmailCommand returns the sendmail-command of account with recipients as
+// arguments. -t is removed: with it, some sendmail implementations remove the
+// addresses given as arguments from the recipients instead of adding them.
+func sendmailCommand(account *Account, recipients []string) (string, []string) {
 	strcmd := strings.Split(account.Sendmail_Command, " ")
-	cmd := exec.Command(strcmd[0], strcmd[1:]...)
-	cmd.Stdin = strings.NewReader(mailcont)
-	output, err := cmd.CombinedOutput()
-	if len(output) != 0 {
-		return errors.New(string(output))
+	var args []string
+	for _, arg := range strcmd[1:] {
+		if arg != "-t" && arg != "--read-recipients" {
+			args = append(args, arg)
+		}
+	}
+	return strcmd[0], append(args, recipients...)
+}
+
+// sendmailError is returned if the sendmail-command exits with an error.
+type sendmailError struct {
+	status int    // exit status
+	output string // what the command printed
+}
+
+// Error implements the error interface.
+func (e *sendmailError) Error() string {
+	if e.output == "" {
+		return fmt.Sprintf("sendmail-command failed with exit status %d.", e.status)
+	}
+	return e.output
+}
+
+// runSendmail runs the sendmail program with args and the mail on stdin.
+// Only the exit status tells whether it failed, as many programs print
+// warnings. The output of a successful run is returned.
+func runSendmail(program string, args []string, mail io.Reader) (string, error) {
+	var output bytes.Buffer
+	cmd := exec.Command(program, args...)
+	cmd.Stdin = mail
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	msg := strings.TrimSpace(output.String())
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return "", &sendmailError{exitErr.ExitCode(), msg}
 	}
 	if err != nil {
-		return err
+		return "", err
+	}
+	return msg, nil
+}
+
+// sentTags returns the tags for sent mail of account.
+func sentTags(account *Account, attachment bool) []string {
+	tags := append([]string(nil), account.Sent_Tag...)
+	if attachment {
+		tags = append(tags, "attachment")
 	}
+	return tags
+}
 
-	filename, err := addToMaildir(expandEnvHome(account.Sent_Dir), []byte(mailcont))
+// indexMail stores content in the maildir dir with the given flags and adds
+// it to the notmuch database. All tags of the message are replaced by tags.
+//
+// It returns the filename of the mail.
+func indexMail(dir, flags string, content []byte, tags []string) (string, error) {
+	filename, err := addToMaildir(expandEnvHome(dir), content, flags)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	db, status := notmuch.OpenDatabase(expandEnvHome(config.General.Database), 1)
+	db, status := openWritable()
 	if status != notmuch.STATUS_SUCCESS {
-		return errors.New(status.String())
+		return filename, errors.New(status.String())
 	}
-	defer db.Close()
+	defer closeWritable(db)
 
+	// a duplicate id means that a draft of this mail is already in the database.
 	msg, status := db.AddMessage(filename)
-	if status != notmuch.STATUS_SUCCESS {
-		return errors.New(status.String())
+	if status != notmuch.STATUS_SUCCESS && status != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		return filename, errors.New(status.String())
 	}
 	defer msg.Destroy()
 
 	msg.Freeze()
 	defer msg.Thaw()
 	msg.RemoveAllTags()
-	for _, tag := range account.Sent_Tag {
+	for _, tag := range tags {
 		status = msg.AddTag(tag)
+		if status != notmuch.STATUS_SUCCESS {
+			return filename, errors.New(status.String())
+		}
 	}
-	if status != notmuch.STATUS_SUCCESS {
-		return errors.New(status.String())
-	}
-
-	// TODO: maybe make this cleaner.
-	if len(m.Parts) > 1 {
-		status = msg.AddTag("attachment")
-	}
-
-	if status != notmuch.STATUS_SUCCESS {
-		return errors.New(status.String())
-	}
-
-	return nil
+	return filename, nil
 }
 
 // inserts a newline character after lineLength bytes. only for ascii because in wider
@@ -519,3 +1353,68 @@ func (n *newlineInserter) Write(data []byte) (int, error) {
 	n.counter += num
 	return written, err
 }
+
+// bounceMail sends the mail in filename unchanged to recipients, which is an
+// address list. Resent-* header fields (RFC 5322) are prepended to it. The
+// account is chosen from the recipients of the mail.
+//
+// The -t option is removed from the sendmail command of the account so that
+// the mail is not sent to its original recipients again. With smtp-host, only
+// recipients are used as envelope recipients.
+func bounceMail(filename, recipients string) error {
+	list, err := mail.ParseAddressList(recipients)
+	if err != nil {
+		return fmt.Errorf("Invalid recipients: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	account := defaultAccount()
+	if own := ownAddress(msg.Header); own != "" {
+		addr, err := mail.ParseAddress(own)
+		if err == nil && getAccount(addr.Address) != nil {
+			account = getAccount(addr.Address)
+		}
+	}
+	if account == nil {
+		return errors.New("No account configured.")
+	}
+	if account.Sendmail_Command == "" && account.Smtp_Host == "" {
+		return errors.New("No sendmail-command or smtp-host configured for account.")
+	}
+
+	// keep the line endings of the file
+	nl := "\n"
+	if i := bytes.IndexByte(content, '\n'); i > 0 && content[i-1] == '\r' {
+		nl = "\r\n"
+	}
+	var buffer bytes.Buffer
+	resent := mail.Header{
+		"Resent-From":       {account.Addr},
+		"Resent-To":         {joinAddresses(list)},
+		"Resent-Date":       {time.Now().Format(time.RFC1123Z)},
+		"Resent-Message-Id": {newMessageID()},
+	}
+	writeHeader(&buffer, resent)
+	resentHeader := strings.Replace(buffer.String(), "\r\n", nl, -1)
+
+	addrs := make([]string, len(list))
+	for i, a := range list {
+		addrs[i] = a.Address
+	}
+	if account.Smtp_Host != "" {
+		return smtpSend(account, addrs, resentHeader+string(content))
+	}
+
+	program, args := sendmailCommand(account, addrs)
+	_, err = runSendmail(program, args,
+		io.MultiReader(strings.NewReader(resentHeader), bytes.NewReader(content)))
+	return err
+}
@@ -1,8 +1,20 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
 package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -16,3 +28,363 @@ func TestNewlineInserter(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSplitMultipart(t *testing.T) {
+	body := "preamble\r\n--b\r\nContent-Type: text/plain\r\n\r\nfirst\r\n\r\n--b\r\n\r\nsecond\n--b--\r\nepilogue"
+	parts := splitMultipart([]byte(body), "b")
+	expected := []string{"Content-Type: text/plain\r\n\r\nfirst\r\n", "\r\nsecond"}
+	if len(parts) != len(expected) {
+		t.Fatalf("got %d parts, expected %d", len(parts), len(expected))
+	}
+	for i := range parts {
+		if string(parts[i]) != expected[i] {
+			t.Errorf("part %d is %q, expected %q", i, parts[i], expected[i])
+		}
+	}
+}
+
+func TestStripHeader(t *testing.T) {
+	content := "From: a@example.com\r\nBcc: b@example.com,\r\n c@example.com\r\nTo: d@example.com\r\n\r\nBcc: body\r\n"
+	expected := "From: a@example.com\r\nTo: d@example.com\r\n\r\nBcc: body\r\n"
+	if stripped := stripHeader(content, "Bcc"); stripped != expected {
+		t.Errorf("got %q, expected %q", stripped, expected)
+	}
+}
+
+func TestChooseReplyRecipients(t *testing.T) {
+	oldAccounts := config.Account
+	config.Account = map[string]*Account{"me": {Addr: "me@example.com"}}
+	defer func() { config.Account = oldAccounts }()
+
+	tests := []struct {
+		header   map[string]string
+		mode     replyMode
+		to, cc   string
+		from     string
+		hasError bool
+	}{
+		{map[string]string{"From": "Alice <alice@example.com>", "To": "Me <me@example.com>, bob@example.com",
+			"Cc": "carol@example.com"}, replySender,
+			"\"Alice\" <alice@example.com>", "", "\"Me\" <me@example.com>", false},
+		{map[string]string{"From": "Alice <alice@example.com>", "To": "Me <me@example.com>, bob@example.com",
+			"Cc": "carol@example.com"}, replyGroup,
+			"\"Alice\" <alice@example.com>, <bob@example.com>", "<carol@example.com>",
+			"\"Me\" <me@example.com>", false},
+		{map[string]string{"From": "alice@example.com", "Reply-To": "list@example.com",
+			"Mail-Reply-To": "alice@home.example.com", "To": "list@example.com", "Cc": "me@example.com"}, replySender,
+			"<alice@home.example.com>", "", "<me@example.com>", false},
+		{map[string]string{"From": "alice@example.com", "Reply-To": "list@example.com",
+			"To": "list@example.com", "Cc": "me@example.com, alice@example.com"}, replyGroup,
+			"<list@example.com>", "<alice@example.com>", "<me@example.com>", false},
+		{map[string]string{"From": "alice@example.com", "To": "list@example.com",
+			"Mail-Followup-To": "list@example.com, me@example.com"}, replyGroup,
+			"<list@example.com>", "", "<list@example.com>", false},
+		{map[string]string{"From": "alice@example.com", "To": "list@example.com",
+			"List-Post": "<mailto:list@example.com?subject=hi>"}, replyList,
+			"<list@example.com>", "", "<list@example.com>", false},
+		{map[string]string{"From": "alice@example.com", "To": "list@example.com",
+			"List-Post": "NO (posting not allowed)"}, replyList, "", "", "", true},
+		{map[string]string{"From": "me@example.com", "To": "bob@example.com"}, replySender,
+			"<bob@example.com>", "", "<bob@example.com>", false},
+	}
+
+	for i, test := range tests {
+		h := make(mail.Header)
+		for key, value := range test.header {
+			h[key] = []string{value}
+		}
+		to, cc, from, err := chooseReplyRecipients(h, test.mode)
+		if test.hasError {
+			if err == nil {
+				t.Errorf("%d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if joinAddresses(to) != test.to || joinAddresses(cc) != test.cc || from != test.from {
+			t.Errorf("%d: got to %q, cc %q, from %q", i, joinAddresses(to), joinAddresses(cc), from)
+		}
+	}
+}
+
+func TestComposeForward(t *testing.T) {
+	oldAccounts := config.Account
+	config.Account = map[string]*Account{"b": {Addr: "me@example.com"}, "a": {Addr: "first@example.com"}}
+	defer func() { config.Account = oldAccounts }()
+
+	text := make(textproto.MIMEHeader)
+	text.Set("Content-Type", "text/plain; charset=iso-8859-1")
+	html := make(textproto.MIMEHeader)
+	html.Set("Content-Type", "text/html")
+	pdf := make(textproto.MIMEHeader)
+	pdf.Set("Content-Type", "application/pdf; name=\"doc.pdf\"")
+	m := &Mail{
+		Header: mail.Header{
+			"From":    {"alice@example.com"},
+			"To":      {"bob@example.com"},
+			"Subject": {"Report"},
+		},
+		Parts: []Part{{text, "Hi Bob\n"}, {html, "<p>Hi Bob</p>"}, {pdf, "%PDF"}},
+	}
+
+	fwd, err := composeForward(m, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fwd.Header.Get("Subject") != "Fwd: Report" || fwd.Header.Get("From") != "first@example.com" {
+		t.Errorf("got header %v", fwd.Header)
+	}
+	if len(fwd.Parts) != 2 {
+		t.Fatalf("got %d parts, expected text and pdf", len(fwd.Parts))
+	}
+	if !strings.Contains(fwd.Parts[0].Body, "From: alice@example.com\n") ||
+		!strings.Contains(fwd.Parts[0].Body, "\nHi Bob\n") {
+		t.Errorf("got body %q", fwd.Parts[0].Body)
+	}
+	if fwd.Parts[1].Header.Get("Content-Transfer-Encoding") != "base64" ||
+		fwd.Parts[1].Body != "JVBERg==" {
+		t.Errorf("got attachment %v", fwd.Parts[1])
+	}
+
+	m.Header["To"] = []string{"Me <me@example.com>"}
+	m.Header["Subject"] = []string{"Fwd: Report"}
+	fwd, err = composeForward(m, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fwd.Header.Get("Subject") != "Fwd: Report" || fwd.Header.Get("From") != "\"Me\" <me@example.com>" {
+		t.Errorf("got header %v", fwd.Header)
+	}
+}
+
+func TestBounceMail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "barely-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the sendmail command stores its arguments and input
+	script := filepath.Join(dir, "sendmail")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+dir+"/args\ncat > "+dir+"/mail\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldAccounts := config.Account
+	config.Account = map[string]*Account{
+		"a": {Addr: "other@example.com"},
+		"b": {Addr: "support@example.com", Sendmail_Command: script + " --account=b -t"},
+	}
+	defer func() { config.Account = oldAccounts }()
+
+	original := "From: alice@example.com\nTo: support@example.com\nSubject: help\n\nPlease help\n"
+	filename := filepath.Join(dir, "original")
+	err = ioutil.WriteFile(filename, []byte(original), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bounceMail(filename, "Bob <bob@example.com>, carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if string(args) != "--account=b bob@example.com carol@example.com\n" {
+		t.Errorf("sendmail called with %q", args)
+	}
+	bounced, _ := ioutil.ReadFile(filepath.Join(dir, "mail"))
+	if !strings.HasPrefix(string(bounced), "Resent-Date: ") || !strings.HasSuffix(string(bounced), "\n"+original) ||
+		!strings.Contains(string(bounced), "\nResent-From: support@example.com\n") ||
+		!strings.Contains(string(bounced), "\nResent-To: \"Bob\" <bob@example.com>, carol@example.com\n") {
+		t.Errorf("bounced mail is %q", bounced)
+	}
+
+	if bounceMail(filename, "not an address") == nil {
+		t.Error("invalid recipients accepted")
+	}
+}
+
+func TestDeliverMail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "barely-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "sendmail")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+dir+"/args\ncat > "+dir+"/mail\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &Account{Addr: "me@example.com", Sendmail_Command: script + " -t"}
+
+	content := "From: me@example.com\r\nTo: bob@example.com\r\nBcc: carol@example.com\r\n" +
+		"X-Barely-Forwarded: <abc@example.com>\r\n\r\nHi\r\n"
+	_, err = deliverMail(account, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if string(args) != "bob@example.com carol@example.com\n" {
+		t.Errorf("sendmail called with %q", args)
+	}
+	sent, _ := ioutil.ReadFile(filepath.Join(dir, "mail"))
+	if string(sent) != "From: me@example.com\r\nTo: bob@example.com\r\n\r\nHi\r\n" {
+		t.Errorf("sent %q", sent)
+	}
+
+	// names in address fields are encoded so that the mail can be parsed again
+	m := testMail()
+	m.Header["From"] = []string{"Me <me@example.com>"}
+	m.Header["To"] = []string{"\"Smith, John\" <john@example.com>, Bob <bob@example.com>"}
+	m.Header["Cc"] = []string{"Jürgen <j@example.com>"}
+	encoded, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = deliverMail(account, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, _ = ioutil.ReadFile(filepath.Join(dir, "args"))
+	if string(args) != "john@example.com bob@example.com j@example.com\n" {
+		t.Errorf("sendmail called with %q", args)
+	}
+	sent, _ = ioutil.ReadFile(filepath.Join(dir, "mail"))
+	if !strings.HasPrefix(string(sent), "Cc: =?utf-8?q?J=C3=BCrgen?= <j@example.com>\r\n") ||
+		!strings.Contains(string(sent), "\r\nTo: \"Smith, John\" <john@example.com>, \"Bob\" <bob@example.com>\r\n") {
+		t.Errorf("sent %q", sent)
+	}
+
+	// only the exit status counts, output is a warning
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\ncat > /dev/null\necho warning >&2\nexit $1\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account.Sendmail_Command = script + " 0"
+	if warning, err := deliverMail(account, content); err != nil || warning != "warning" {
+		t.Errorf("got warning %q, error %v", warning, err)
+	}
+	account.Sendmail_Command = script + " 1"
+	if _, err := deliverMail(account, content); err == nil || retryable(err) {
+		t.Errorf("got error %v for failing sendmail-command", err)
+	}
+	account.Sendmail_Command = script + " 75"
+	if _, err := deliverMail(account, content); err == nil || !retryable(err) {
+		t.Errorf("got error %v for temporary failure", err)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&textproto.Error{Code: 451, Msg: "try again later"}, true},
+		{&textproto.Error{Code: 550, Msg: "no such user"}, false},
+		{&textproto.Error{Code: 535, Msg: "authentication failed"}, false},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{errors.New("No smtp-password-command configured for account."), false},
+	}
+	for _, test := range tests {
+		if retryable(test.err) != test.retryable {
+			t.Errorf("retryable(%v) != %v", test.err, test.retryable)
+		}
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	for field, expected := range map[string]string{
+		"<abc@example.com>":                    "abc@example.com",
+		" <abc@example.com> (Alice's message)": "abc@example.com",
+		"abc@example.com":                      "abc@example.com",
+		"":                                     "",
+		"<abc@example.com>\r\n <def@example.com>": "abc@example.com",
+	} {
+		if id := messageID(field); id != expected {
+			t.Errorf("messageID(%q) = %q, expected %q", field, id, expected)
+		}
+	}
+
+	m := &Mail{Header: mail.Header{"Message-Id": {"<abc@example.com>"}, "Subject": {"test"}}}
+	fwd, err := composeForward(m, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := messageID(fwd.clone().Header.Get(ForwardedHeader)); id != "abc@example.com" {
+		t.Errorf("forwarded message id is %q", id)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "barely-signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sigFile := filepath.Join(dir, "signature")
+	if err := ioutil.WriteFile(sigFile, []byte("Bob\nExample Corp\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldAccounts := config.Account
+	config.Account = map[string]*Account{
+		"work": {
+			Addr:              "bob@example.com",
+			Signature:         sigFile,
+			Reply_Attribution: "On %date, %name <%addr> wrote about 100%%:",
+			Forward_Header:    "Begin forwarded message (%subject):",
+		},
+		"home": {Addr: "bob@example.org", Signature_Command: "echo -- \nBobby"},
+	}
+	defer func() { config.Account = oldAccounts }()
+
+	m := &Mail{
+		Header: mail.Header{
+			"From":    {"Alice <alice@example.com>"},
+			"To":      {"bob@example.com"},
+			"Subject": {"Report"},
+			"Date":    {"Mon, 02 Jan 2006 15:04:05 +0000"},
+		},
+		Parts: []Part{{textproto.MIMEHeader{"Content-Type": {"text/plain"}}, "Hi Bob\n"}},
+	}
+
+	reply, err := composeReply(m, replySender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "On 2006-01-02 15:04, Alice <alice@example.com> wrote about 100%:\n> Hi Bob\n\n-- \nBob\nExample Corp\n"
+	if reply.Parts[0].Body != expected {
+		t.Errorf("got reply %q", reply.Parts[0].Body)
+	}
+
+	fwd, err := composeForward(m, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(fwd.Parts[0].Body, "\n-- \nBob\nExample Corp\n\nBegin forwarded message (Report):\nFrom: ") {
+		t.Errorf("got forward %q", fwd.Parts[0].Body)
+	}
+
+	m.Header["To"] = []string{"bob@example.org"}
+	reply, err = composeReply(m, replySender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "Quoting Alice (2006-01-02 15:04):\n> Hi Bob\n\n-- \nBobby\n"
+	if reply.Parts[0].Body != expected {
+		t.Errorf("got reply %q", reply.Parts[0].Body)
+	}
+
+	m.Header["To"] = []string{"alice@example.org"}
+	reply, err = composeReply(m, replySender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(reply.Parts[0].Body, "-- \n") {
+		t.Errorf("got signature without account: %q", reply.Parts[0].Body)
+	}
+}
@@ -70,6 +70,15 @@ func NewMailBufferFromMail(m *Mail) *MailBuffer {
 
 const mbHeaderHeight = 5 // lines occupied by the header field
 
+// headerHeight returns the number of lines occupied by the header field. It
+// has an additional line if the mail is signed or encrypted.
+func (b *MailBuffer) headerHeight() int {
+	if b.mail.Security.String() != "" {
+		return mbHeaderHeight + 1
+	}
+	return mbHeaderHeight
+}
+
 func formatPlain(buf []termbox.Cell, y, w int, text string) ([]termbox.Cell, int) {
 	line := make([]termbox.Cell, w)
 	x := 0
@@ -130,17 +139,102 @@ func renderHtml(htmlCode, tmpFileName string) (plain string, err error) {
 	return string(plainb), err
 }
 
-// refreshBuf preformats the whole mail so that redrawing it while scrolling is faster.
-func (b *MailBuffer) refreshBuf() {
-	w, _ := termbox.Size()
-	b.buffer = b.buffer[:0]
-	b.partLines = make([]int, len(b.mail.Parts))
-	line := make([]termbox.Cell, w)
-	y := 0
-	for i, part := range b.mail.Parts {
-		x := 0
-		b.buffer = append(b.buffer, line...)
+// htmlCache maps html code to its rendered plain text and htmlPending contains
+// html code that is currently being rendered. They may only be accessed from the
+// main loop. htmlCacheOrder lists the cached html code, least recently used first.
+var htmlCache = make(map[string]string)
+var htmlCacheOrder []string
+var htmlPending = make(map[string]bool)
+
+// htmlCacheSize is the number of rendered html parts kept in htmlCache.
+const htmlCacheSize = 32
+
+// cachedHtml returns the rendered plain text of htmlCode if it is in htmlCache.
+func cachedHtml(htmlCode string) (string, bool) {
+	plain, ok := htmlCache[htmlCode]
+	if ok {
+		for i, code := range htmlCacheOrder {
+			if code == htmlCode {
+				htmlCacheOrder = append(htmlCacheOrder[:i], htmlCacheOrder[i+1:]...)
+				break
+			}
+		}
+		htmlCacheOrder = append(htmlCacheOrder, htmlCode)
+	}
+	return plain, ok
+}
+
+// cacheHtml adds rendered html code to htmlCache. The least recently used
+// entry is dropped if the cache is full.
+func cacheHtml(htmlCode, plain string) {
+	if _, ok := htmlCache[htmlCode]; ok {
+		return
+	}
+	if len(htmlCacheOrder) >= htmlCacheSize {
+		delete(htmlCache, htmlCacheOrder[0])
+		htmlCacheOrder = htmlCacheOrder[1:]
+	}
+	htmlCache[htmlCode] = plain
+	htmlCacheOrder = append(htmlCacheOrder, htmlCode)
+}
+
+// htmlFileCounter is used to give every rendered html file a unique name.
+var htmlFileCounter int
 
+// renderHtmlAsync renders htmlCode in the background and stores the result in
+// htmlCache. All buffers are redrawn afterwards to show the result.
+func renderHtmlAsync(htmlCode, tmpDir string) {
+	if htmlPending[htmlCode] {
+		return
+	}
+	htmlPending[htmlCode] = true
+
+	htmlFileCounter++
+	filename := fmt.Sprintf("%s/part%d.html", tmpDir, htmlFileCounter)
+	go func() {
+		defer exitOnPanic()
+		plain, err := renderHtml(htmlCode, filename)
+		postEvent(func(stack *BufferStack) {
+			if err != nil {
+				StatusLine = "Could not display HTML: " + err.Error()
+				plain = ""
+			}
+			delete(htmlPending, htmlCode)
+			cacheHtml(htmlCode, plain)
+			// preformat the buffers again to include the rendered text
+			for _, buf := range stack.buffers {
+				buf.HandleCommand("resize", nil, stack)
+			}
+			stack.refresh()
+		})
+	}()
+}
+
+// formatLine appends a single line of text in color fg to buf and returns the extended
+// buffer and the next line. Text exceeding the width w is cut off.
+func formatLine(buf []termbox.Cell, y, w int, text string, fg termbox.Attribute) ([]termbox.Cell, int) {
+	buf = append(buf, make([]termbox.Cell, w)...)
+	x := 0
+	for _, ch := range text {
+		if x >= w {
+			break
+		}
+		buf[y*w+x] = termbox.Cell{Ch: ch, Fg: fg, Bg: 0}
+		x++
+	}
+	for ; x < w; x++ {
+		buf[y*w+x] = termbox.Cell{Ch: 0, Fg: 0, Bg: 0}
+	}
+	return buf, y + 1
+}
+
+// formatParts preformats all parts of m starting in line y. It returns the extended
+// buffer, the next line and the lines where each part starts.
+//
+// tmpDir is used to store temporary files needed for rendering html.
+func formatParts(buf []termbox.Cell, y, w int, m *Mail, tmpDir string) ([]termbox.Cell, int, []int) {
+	partLines := make([]int, len(m.Parts))
+	for i, part := range m.Parts {
 		contentType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
 		if err != nil {
 			continue
@@ -150,54 +244,65 @@ func (b *MailBuffer) refreshBuf() {
 			contentStr += ": \"" + name + "\""
 		}
 
-		b.partLines[i] = y
-		str := []rune("-- " + contentStr + " --")
-		for ; x < min(w, len(str)); x++ {
-			b.buffer[y*w+x] = termbox.Cell{str[x], termbox.Attribute(config.Theme.Date), 0}
-		}
-		for ; x < w; x++ {
-			b.buffer[y*w+x] = termbox.Cell{0, 0, 0}
-		}
-		y++
+		partLines[i] = y
+		buf, y = formatLine(buf, y, w, "-- "+contentStr+" --", termbox.Attribute(config.Theme.Date))
 
 		if contentType == "text/plain" {
-			b.buffer, y = formatPlain(b.buffer, y, w, part.Body)
+			buf, y = formatPlain(buf, y, w, part.Body)
 		}
 
 		// if the first part is html, convert to plain text
 		if contentType == "text/html" && i == 0 {
-			plain, err := renderHtml(part.Body, b.tmpDir+"/part0.html")
-			if err != nil {
-				StatusLine = "Could not display HTML: " + err.Error()
-			} else {
-				b.buffer, y = formatPlain(b.buffer, y, w, plain)
+			plain, ok := cachedHtml(part.Body)
+			if !ok {
+				renderHtmlAsync(part.Body, tmpDir)
+				plain = "rendering HTML..."
 			}
+			buf, y = formatPlain(buf, y, w, plain)
 		}
 
 	}
+	return buf, y, partLines
+}
+
+// refreshBuf preformats the whole mail so that redrawing it while scrolling is faster.
+func (b *MailBuffer) refreshBuf() {
+	w, _ := termbox.Size()
+	b.buffer, _, b.partLines = formatParts(b.buffer[:0], 0, w, b.mail, b.tmpDir)
 	if b.cursor >= len(b.buffer)/w {
 		b.cursor = len(b.buffer)/w - 1
 	}
 }
 
-func (b *MailBuffer) drawHeader() {
-	getHeader := func(key string) string {
-		dec := &mime.WordDecoder{charset.NewReader}
-		str, err := dec.DecodeHeader(b.mail.Header.Get(key))
-		if err != nil {
-			str = err.Error()
-		}
-		return str
+// decodeHeader returns the header field key of m with MIME encoded-words decoded.
+func decodeHeader(m *Mail, key string) string {
+	dec := &mime.WordDecoder{charset.NewReader}
+	str, err := dec.DecodeHeader(m.Header.Get(key))
+	if err != nil {
+		str = err.Error()
 	}
+	return str
+}
+
+func (b *MailBuffer) drawHeader() {
 	drawField := func(y int, label, value string) {
 		printLine(0, y, "| "+label+": ", config.Theme.Subject|int(termbox.AttrBold), -1)
 		printLine(len(label)+4, y, value, -1, -1)
 	}
 
-	drawField(0, "Date", getHeader("Date"))
-	drawField(1, "From", getHeader("From"))
-	drawField(2, "To", getHeader("To"))
-	drawField(3, "Subject", getHeader("Subject"))
+	drawField(0, "Date", decodeHeader(b.mail, "Date"))
+	drawField(1, "From", decodeHeader(b.mail, "From"))
+	drawField(2, "To", decodeHeader(b.mail, "To"))
+	drawField(3, "Subject", decodeHeader(b.mail, "Subject"))
+
+	if sec := b.mail.Security.String(); sec != "" {
+		fg := config.Theme.Date
+		if b.mail.Security.Bad() {
+			fg = config.Theme.Error
+		}
+		printLine(0, 4, "| Security: ", config.Theme.Subject|int(termbox.AttrBold), -1)
+		printLine(len("Security")+4, 4, sec, fg, -1)
+	}
 }
 
 // Draw draws the content of the buffer.
@@ -206,27 +311,28 @@ func (b *MailBuffer) Draw() {
 	cbuf := termbox.CellBuffer()
 
 	b.drawHeader()
+	headerHeight := b.headerHeight()
 	offset := 0
 	if b.cursor >= h*3/4 {
 		offset = -h*3/4 + b.cursor
 	}
 
 	y := 0
-	for ; y < min(len(b.buffer)/w-offset, h-2-mbHeaderHeight); y++ {
+	for ; y < min(len(b.buffer)/w-offset, h-2-headerHeight); y++ {
 		for x := 0; x < w; x++ {
-			cbuf[(y+mbHeaderHeight)*w+x] = b.buffer[(y+offset)*w+x]
+			cbuf[(y+headerHeight)*w+x] = b.buffer[(y+offset)*w+x]
 		}
 	}
 
-	for ; y < h-2-mbHeaderHeight; y++ {
+	for ; y < h-2-headerHeight; y++ {
 		for x := 0; x < w; x++ {
-			cbuf[(y+mbHeaderHeight)*w+x] = termbox.Cell{0, 0, 0}
+			cbuf[(y+headerHeight)*w+x] = termbox.Cell{0, 0, 0}
 		}
 	}
 
-	if b.cursor-offset >= 0 && b.cursor-offset < h-2-mbHeaderHeight {
+	if b.cursor-offset >= 0 && b.cursor-offset < h-2-headerHeight {
 		for x := 0; x < w; x++ {
-			cbuf[(b.cursor-offset+mbHeaderHeight)*w+x].Bg = termbox.Attribute(config.Theme.HlBg)
+			cbuf[(b.cursor-offset+headerHeight)*w+x].Bg = termbox.Attribute(config.Theme.HlBg)
 		}
 	}
 
@@ -301,6 +407,31 @@ func openAttachment(p *Part, dir string) {
 	go cmd.Wait()
 }
 
+// bounceCmd bounces the mail in filename to the recipients given as args in the
+// background.
+func bounceCmd(filename string, args []string) {
+	if filename == "" {
+		StatusLine = "Only stored messages can be bounced."
+		return
+	}
+	recipients := strings.Join(args, " ")
+	if recipients == "" {
+		StatusLine = "Usage: bounce <recipients>"
+		return
+	}
+	StatusLine = "Bouncing..."
+	runAsync(func() error {
+		return bounceMail(filename, recipients)
+	}, func(stack *BufferStack, err error) {
+		if err != nil {
+			StatusLine = err.Error()
+		} else {
+			StatusLine = "Bounced to " + recipients
+		}
+		stack.refresh()
+	})
+}
+
 // searchCmd searches the mail body for a string and returns the cursor position for that string.
 // If reverse is true, the search is done backwards.
 func (b *MailBuffer) searchCmd(term string, reverse bool) int {
@@ -401,12 +532,24 @@ func (b *MailBuffer) HandleCommand(cmd string, args []string, stack *BufferStack
 		termbox.Init()
 		termbox.Sync()
 		stack.refresh()
-	case "reply":
-		reply := composeReply(b.mail, false)
-		stack.Push(NewComposeBuffer(reply))
-	case "groupreply":
-		reply := composeReply(b.mail, true)
+	case "reply", "groupreply", "listreply":
+		reply, err := composeReply(b.mail, replyModes[cmd])
+		if err != nil {
+			StatusLine = err.Error()
+			break
+		}
 		stack.Push(NewComposeBuffer(reply))
+	case "forward", "forwardattach":
+		fwd, err := composeForward(b.mail, b.filename, cmd == "forwardattach")
+		if err != nil {
+			StatusLine = err.Error()
+			break
+		}
+		stack.Push(NewComposeBuffer(fwd))
+	case "bounce":
+		bounceCmd(b.filename, args)
+	case "resume":
+		stack.Push(NewComposeBufferFromDraft(b.filename))
 	case "search":
 		if len(args) > 0 {
 			b.lastSearch = strings.Join(args, " ")
@@ -0,0 +1,184 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/laochailan/notmuch-go"
+)
+
+// OutboxTag is the tag mail waiting in the outbox is indexed with.
+const OutboxTag = "outbox"
+
+// outboxCount is the number of mails waiting in the outboxes of all accounts.
+// It is updated by updateOutboxCount.
+var outboxCount int
+
+// queuedError is returned by sendMail if a mail could not be sent and was put
+// into the outbox instead.
+type queuedError struct {
+	err error
+}
+
+// Error implements the error interface.
+func (e *queuedError) Error() string {
+	return "Sending failed, mail queued in outbox: " + e.err.Error()
+}
+
+// retryable returns true if delivery failed with err for a reason that may go
+// away, e.g. an unreachable server or a temporary rejection. Mail rejected for
+// good must not be queued, as the user has to change it.
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *sendmailError:
+		// EX_UNAVAILABLE and EX_TEMPFAIL of sysexits.h, used e.g. by msmtp
+		// without network
+		return e.status == 69 || e.status == 75
+	case *textproto.Error:
+		return e.Code >= 400 && e.Code < 500
+	case net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// queuedTags returns the tags for m in the outbox.
+func queuedTags(m *Mail) []string {
+	tags := []string{OutboxTag}
+	if len(m.Parts) > 1 {
+		tags = append(tags, "attachment")
+	}
+	return tags
+}
+
+// queueMail encodes m as selected by opts and stores it in the outbox of its
+// account to be sent later by flushOutbox.
+func queueMail(m *Mail, opts cryptoOptions) error {
+	account, mailcont, err := prepareMail(m, opts)
+	if err != nil {
+		return err
+	}
+	if account.Outbox_Dir == "" {
+		return errors.New("No outbox-dir configured for account.")
+	}
+	_, err = indexMail(account.Outbox_Dir, "", []byte(mailcont), queuedTags(m))
+	return err
+}
+
+// outboxDirs returns the distinct outbox directories of all accounts.
+func outboxDirs() []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, account := range config.Account {
+		dir := account.Outbox_Dir
+		if dir != "" && !seen[expandEnvHome(dir)] {
+			seen[expandEnvHome(dir)] = true
+			dirs = append(dirs, expandEnvHome(dir))
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// queuedFiles returns the files of all mails in the outboxes.
+func queuedFiles() []string {
+	var files []string
+	for _, dir := range outboxDirs() {
+		for _, sub := range []string{"new", "cur"} {
+			names, _ := filepath.Glob(filepath.Join(dir, sub, "*"))
+			files = append(files, names...)
+		}
+	}
+	return files
+}
+
+// updateOutboxCount counts the mails waiting in the outboxes.
+func updateOutboxCount() {
+	outboxCount = len(queuedFiles())
+}
+
+// queuedAttachment returns true if the queued mail with header h is tagged
+// as having attachments.
+func queuedAttachment(h mail.Header) bool {
+	db, status := notmuch.OpenDatabase(expandEnvHome(config.General.Database), 0)
+	if status != notmuch.STATUS_SUCCESS {
+		return false
+	}
+	defer db.Close()
+
+	id := strings.Trim(strings.TrimSpace(h.Get("Message-Id")), "<>")
+	msg, status := db.FindMessage(id)
+	if status != notmuch.STATUS_SUCCESS || msg == nil {
+		return false
+	}
+	defer msg.Destroy()
+	return hasTag(msg, "attachment")
+}
+
+// flushOutbox sends all queued mails with the account matching their From
+// address and moves them to the sent-dir of the account. Mails that cannot be
+// sent stay in the outbox and do not keep the others from being sent.
+//
+// It returns the headers of the mails sent, the number of mails that failed,
+// and an error describing the failures.
+func flushOutbox() (sent []mail.Header, failed int, err error) {
+	var errs []string
+	for _, filename := range queuedFiles() {
+		h, ferr := flushMail(filename)
+		if h != nil {
+			sent = append(sent, h)
+		} else {
+			failed++
+		}
+		if ferr != nil {
+			errs = append(errs, filepath.Base(filename)+": "+ferr.Error())
+		}
+	}
+	if len(errs) > 0 {
+		err = errors.New(strings.Join(errs, "; "))
+	}
+	return sent, failed, err
+}
+
+// flushMail sends the queued mail in filename and moves it to the sent-dir.
+// If the mail was sent, even if moving it failed, its header is returned.
+func flushMail(filename string) (mail.Header, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(content)))
+	if err != nil {
+		return nil, err
+	}
+	account, err := fromAccount(&Mail{Header: msg.Header})
+	if err != nil {
+		return nil, err
+	}
+	if account.Sent_Dir == "" {
+		return nil, errors.New("No sent-dir configured for account.")
+	}
+
+	_, err = deliverMail(account, string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	tags := sentTags(account, queuedAttachment(msg.Header))
+	_, err = indexMail(account.Sent_Dir, "S", []byte(stripHeader(string(content), ForwardedHeader)), tags)
+	if err == nil {
+		err = removeMailFile(filename)
+	}
+	return msg.Header, err
+}
@@ -0,0 +1,542 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// gpgCommand creates a command running the configured gpg program with args.
+func gpgCommand(args ...string) *exec.Cmd {
+	strcmd := strings.Split(config.Commands.Gpg, " ")
+	return exec.Command(strcmd[0], append(strcmd[1:], args...)...)
+}
+
+// runGpg runs gpg with args and input on stdin. It returns the output and the
+// status lines gpg writes to stderr (see --status-fd in gpg's documentation).
+// The output is returned even if gpg fails, e.g. decrypted text with a bad
+// signature.
+func runGpg(input []byte, args ...string) (output []byte, status []string, err error) {
+	var stdout, stderr bytes.Buffer
+	cmd := gpgCommand(append([]string{"--batch", "--status-fd", "2"}, args...)...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+
+	var messages []string
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if strings.HasPrefix(line, "[GNUPG:] ") {
+			status = append(status, strings.TrimPrefix(line, "[GNUPG:] "))
+		} else if strings.TrimSpace(line) != "" {
+			messages = append(messages, strings.TrimSpace(line))
+		}
+	}
+	if err != nil {
+		if len(messages) > 0 {
+			return stdout.Bytes(), status, errors.New("gpg: " + strings.Join(messages, " "))
+		}
+		return stdout.Bytes(), status, fmt.Errorf("gpg: %s", err)
+	}
+	return stdout.Bytes(), status, nil
+}
+
+// pgpHashNames maps OpenPGP hash algorithm ids (RFC 4880) to micalg parameter
+// values (RFC 3156).
+var pgpHashNames = map[string]string{
+	"1":  "pgp-md5",
+	"2":  "pgp-sha1",
+	"3":  "pgp-ripemd160",
+	"8":  "pgp-sha256",
+	"9":  "pgp-sha384",
+	"10": "pgp-sha512",
+	"11": "pgp-sha224",
+}
+
+// pgpSign creates an ASCII armored detached signature of content. If key is
+// empty, gpg's default key is used. It also returns the micalg parameter
+// for the multipart/signed content type.
+func pgpSign(content []byte, key string) (sig []byte, micalg string, err error) {
+	args := []string{"--armor", "--detach-sign"}
+	if key != "" {
+		args = append(args, "--local-user", key)
+	}
+	sig, status, err := runGpg(content, args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	micalg = "pgp-sha256"
+	for _, line := range status {
+		// SIG_CREATED <type> <pubkey algo> <hash algo> <class> <timestamp> <fpr>
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == "SIG_CREATED" {
+			if name, ok := pgpHashNames[fields[3]]; ok {
+				micalg = name
+			}
+		}
+	}
+	return sig, micalg, nil
+}
+
+// canonicalCRLF converts all line endings of str to CRLF as required for
+// signed content.
+func canonicalCRLF(str string) string {
+	str = strings.Replace(str, "\r\n", "\n", -1)
+	return strings.Replace(str, "\n", "\r\n", -1)
+}
+
+// encodeEntity encodes the content of the mail as a MIME entity including
+// its content headers, with canonical line endings.
+func (m *Mail) encodeEntity() (string, error) {
+	header, body, err := m.encodeContent()
+	if err != nil {
+		return "", err
+	}
+	var entity bytes.Buffer
+	writeHeader(&entity, mail.Header(header))
+	entity.WriteString("\r\n")
+	entity.WriteString(body)
+	return canonicalCRLF(entity.String()), nil
+}
+
+// encodeSigned encodes the mail as PGP/MIME signed message (RFC 3156) signed
+// with key.
+func (m *Mail) encodeSigned(key string) (string, error) {
+	content, err := m.encodeEntity()
+	if err != nil {
+		return "", err
+	}
+
+	sig, micalg, err := pgpSign([]byte(content), key)
+	if err != nil {
+		return "", err
+	}
+
+	return m.encodeMultipartSigned(content, "application/pgp-signature", micalg,
+		"Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n"+
+			"Content-Description: OpenPGP digital signature\r\n",
+		canonicalCRLF(string(sig))), nil
+}
+
+// encodeMultipartSigned encodes the mail as multipart/signed message (RFC 1847)
+// made of the signed content and the signature part with the given header
+// lines and body.
+func (m *Mail) encodeMultipartSigned(content, protocol, micalg, sigHeader, sig string) string {
+	boundary := randomBoundary()
+	delete(m.Header, "Content-Transfer-Encoding")
+	m.Header["Content-Type"] = []string{"multipart/signed; micalg=" + micalg +
+		"; protocol=\"" + protocol + "\"; boundary=" + boundary}
+
+	var buffer bytes.Buffer
+	writeHeader(&buffer, m.Header)
+	buffer.WriteString("\r\n--" + boundary + "\r\n")
+	buffer.WriteString(content)
+	buffer.WriteString("\r\n--" + boundary + "\r\n")
+	buffer.WriteString(sigHeader + "\r\n")
+	buffer.WriteString(sig)
+	buffer.WriteString("\r\n--" + boundary + "--\r\n")
+	return buffer.String()
+}
+
+// pgpHasKey returns true if gpg knows a valid encryption key for addr.
+func pgpHasKey(addr string) bool {
+	out, _, err := runGpg(nil, "--with-colons", "--list-keys", "<"+addr+">")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// pub:<validity>:<length>:<algo>:<keyid>:<created>:<expires>:...:<capabilities>
+		fields := strings.Split(line, ":")
+		if len(fields) < 12 || fields[0] != "pub" {
+			continue
+		}
+		if strings.ContainsAny(fields[1], "ernd") { // expired, revoked, never trusted, disabled
+			continue
+		}
+		if strings.Contains(fields[11], "E") {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptionRecipients returns the addresses of the recipients of m in To
+// and Cc, and separately those in Bcc.
+func encryptionRecipients(m *Mail) (recipients, bcc []string, err error) {
+	recipients, err = m.addresses("To", "Cc")
+	if err != nil {
+		return nil, nil, err
+	}
+	bcc, err = m.addresses("Bcc")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(recipients) == 0 && len(bcc) == 0 {
+		return nil, nil, errors.New("No recipients to encrypt for.")
+	}
+	return recipients, bcc, nil
+}
+
+// pgpEncrypt encrypts content for all recipients and the hidden recipients,
+// whose key ids are left out of the message. self is added as recipient
+// if a key exists for it so that the sent mail stays readable. If sign is true,
+// the content is signed with key as well.
+func pgpEncrypt(content []byte, recipients, hidden []string, self, key string, sign bool) ([]byte, error) {
+	var missing []string
+	for _, r := range append(recipients[:len(recipients):len(recipients)], hidden...) {
+		if !pgpHasKey(r) {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.New("Not sent. No PGP key for " + strings.Join(missing, ", "))
+	}
+
+	args := []string{"--armor", "--encrypt"}
+	if sign {
+		args = append(args, "--sign")
+		if key != "" {
+			args = append(args, "--local-user", key)
+		}
+	}
+	if pgpHasKey(self) {
+		recipients = append(recipients, self)
+	}
+	for _, r := range recipients {
+		args = append(args, "--recipient", "<"+r+">")
+	}
+	for _, r := range hidden {
+		args = append(args, "--hidden-recipient", "<"+r+">")
+	}
+
+	out, _, err := runGpg(content, args...)
+	return out, err
+}
+
+// encodeEncrypted encodes the mail as PGP/MIME encrypted message (RFC 3156)
+// for all recipients. If sign is true, it is signed with the key of account.
+func (m *Mail) encodeEncrypted(account *Account, sign bool) (string, error) {
+	recipients, bcc, err := encryptionRecipients(m)
+	if err != nil {
+		return "", err
+	}
+	content, err := m.encodeEntity()
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := pgpEncrypt([]byte(content), recipients, bcc, account.Addr, account.Pgp_Key, sign)
+	if err != nil {
+		return "", err
+	}
+
+	boundary := randomBoundary()
+	delete(m.Header, "Content-Transfer-Encoding")
+	m.Header["Content-Type"] = []string{"multipart/encrypted; " +
+		"protocol=\"application/pgp-encrypted\"; boundary=" + boundary}
+
+	var buffer bytes.Buffer
+	writeHeader(&buffer, m.Header)
+	buffer.WriteString("\r\n--" + boundary + "\r\n")
+	buffer.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	buffer.WriteString("Content-Description: PGP/MIME version identification\r\n\r\n")
+	buffer.WriteString("Version: 1\r\n")
+	buffer.WriteString("\r\n--" + boundary + "\r\n")
+	buffer.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	buffer.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	buffer.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+	buffer.WriteString(canonicalCRLF(string(encrypted)))
+	buffer.WriteString("\r\n--" + boundary + "--\r\n")
+	return buffer.String(), nil
+}
+
+// pgpKeyAddresses returns the addresses in the valid user ids of key.
+func pgpKeyAddresses(key string) []string {
+	out, _, err := runGpg(nil, "--with-colons", "--list-keys", key)
+	if err != nil {
+		return nil
+	}
+	var addrs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 10 || fields[0] != "uid" || fields[1] == "r" || fields[1] == "e" {
+			continue
+		}
+		if addr, err := mail.ParseAddress(fields[9]); err == nil {
+			addrs = append(addrs, addr.Address)
+		}
+	}
+	return addrs
+}
+
+// pgpSignatures extracts the results of signature checks from gpg's status
+// lines. Good signatures by keys that are not certified are untrusted.
+func pgpSignatures(status []string) []Signature {
+	var sigs []Signature
+	for _, line := range status {
+		// VALIDSIG and TRUST_* follow the line of the signature they belong to
+		if len(sigs) > 0 {
+			last := &sigs[len(sigs)-1]
+			switch {
+			case strings.HasPrefix(line, "VALIDSIG "):
+				// VALIDSIG <fpr> ... <primary key fpr>
+				fields := strings.Fields(line)
+				last.addrs = pgpKeyAddresses(fields[len(fields)-1])
+			case strings.HasPrefix(line, "TRUST_UNDEFINED"), strings.HasPrefix(line, "TRUST_NEVER"):
+				if last.Status == SigGood {
+					last.Status = SigUntrusted
+				}
+			}
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 {
+			continue
+		}
+		uid := ""
+		if len(fields) == 3 {
+			uid = fields[2]
+		}
+		switch fields[0] {
+		case "GOODSIG":
+			sigs = append(sigs, Signature{Status: SigGood, Signer: uid})
+		case "BADSIG":
+			sigs = append(sigs, Signature{Status: SigBad, Signer: uid})
+		case "EXPSIG":
+			sigs = append(sigs, Signature{Status: SigBad, Signer: uid, Detail: "signature expired"})
+		case "EXPKEYSIG":
+			sigs = append(sigs, Signature{Status: SigBad, Signer: uid, Detail: "key expired"})
+		case "REVKEYSIG":
+			sigs = append(sigs, Signature{Status: SigBad, Signer: uid, Detail: "key revoked"})
+		case "ERRSIG":
+			// ERRSIG <keyid> <pkalgo> <hashalgo> <sig_class> <time> <rc> ...
+			errFields := strings.Fields(line)
+			if len(errFields) >= 7 && errFields[6] == "9" {
+				sigs = append(sigs, Signature{Status: SigUnknownKey, Signer: fields[1]})
+			} else {
+				sigs = append(sigs, Signature{Status: SigError, Signer: fields[1]})
+			}
+		}
+	}
+	return sigs
+}
+
+// pgpVerify checks the detached signature sig of content.
+func pgpVerify(content, sig []byte) []Signature {
+	sigFile, err := ioutil.TempFile("", "barely-signature")
+	if err != nil {
+		return []Signature{{Status: SigError, Detail: err.Error()}}
+	}
+	defer os.Remove(sigFile.Name())
+	_, err = sigFile.Write(sig)
+	sigFile.Close()
+	if err != nil {
+		return []Signature{{Status: SigError, Detail: err.Error()}}
+	}
+
+	_, status, err := runGpg(content, "--verify", sigFile.Name(), "-")
+	sigs := pgpSignatures(status)
+	if len(sigs) == 0 && err != nil {
+		return []Signature{{Status: SigError, Detail: err.Error()}}
+	}
+	return sigs
+}
+
+// pgpDecrypt decrypts an ASCII armored message or checks a clearsigned one.
+// It returns the plain text and the signatures found.
+//
+// gpg also fails if a signature is bad or cannot be checked. The text is only
+// returned then if it was decrypted with intact integrity or only signed, so
+// that the signature status explains the failure.
+func pgpDecrypt(data []byte) ([]byte, []Signature, error) {
+	plain, status, err := runGpg(data, "--decrypt")
+	sigs := pgpSignatures(status)
+	if err == nil {
+		return plain, sigs, nil
+	}
+
+	encrypted, decrypted := false, false
+	for _, line := range status {
+		switch strings.SplitN(line, " ", 2)[0] {
+		case "BEGIN_DECRYPTION":
+			encrypted = true
+		case "DECRYPTION_OKAY":
+			decrypted = true
+		case "DECRYPTION_FAILED", "BADMDC":
+			return nil, sigs, err
+		}
+	}
+	if encrypted && !decrypted {
+		return nil, sigs, err
+	}
+	for _, sig := range sigs {
+		if sig.Status != SigGood {
+			return plain, sigs, nil
+		}
+	}
+	return nil, sigs, err
+}
+
+// readPgpSigned reads a multipart/signed body with a PGP signature (RFC 3156),
+// verifies it and reads the signed content.
+func (m *Mail) readPgpSigned(body io.Reader, boundary string) error {
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	parts := splitMultipart(raw, boundary)
+	if len(parts) != 2 {
+		return m.readParts(bytes.NewReader(raw), boundary)
+	}
+
+	_, sigReader, err := parseEntity(parts[1])
+	if err != nil {
+		return err
+	}
+	sig, err := ioutil.ReadAll(sigReader)
+	if err != nil {
+		return err
+	}
+	m.Security.Signatures = append(m.Security.Signatures,
+		pgpVerify([]byte(canonicalCRLF(string(parts[0]))), sig)...)
+
+	header, content, err := parseEntity(parts[0])
+	if err != nil {
+		return err
+	}
+	return m.readPart(header, content)
+}
+
+// readPgpEncrypted reads a multipart/encrypted body (RFC 3156) and decrypts it.
+// If decryption fails, the encrypted parts are read as they are.
+func (m *Mail) readPgpEncrypted(body io.Reader, boundary string) error {
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m.Security.Encrypted = true
+	parts := splitMultipart(raw, boundary)
+	if len(parts) != 2 {
+		return m.readParts(bytes.NewReader(raw), boundary)
+	}
+
+	_, encReader, err := parseEntity(parts[1])
+	if err != nil {
+		return err
+	}
+	encrypted, err := ioutil.ReadAll(encReader)
+	if err != nil {
+		return err
+	}
+	plain, sigs, err := pgpDecrypt(encrypted)
+	if err != nil {
+		m.Security.Errors = append(m.Security.Errors, "decryption failed: "+err.Error())
+		return m.readParts(bytes.NewReader(raw), boundary)
+	}
+	m.Security.Signatures = append(m.Security.Signatures, sigs...)
+
+	header, content, err := parseEntity(plain)
+	if err != nil {
+		return err
+	}
+	return m.readPart(header, content)
+}
+
+// inlinePgpBlocks are the delimiters of inline PGP messages.
+var inlinePgpBlocks = []struct {
+	begin, end string
+	encrypted  bool
+}{
+	{"-----BEGIN PGP MESSAGE-----", "-----END PGP MESSAGE-----", true},
+	{"-----BEGIN PGP SIGNED MESSAGE-----", "-----END PGP SIGNATURE-----", false},
+}
+
+// findInlinePgp returns the position of the first inline PGP block in text
+// and the index of its type in inlinePgpBlocks. The block has to start at the
+// beginning of a line so that quoted blocks are left alone.
+func findInlinePgp(text []byte) (pos, block int) {
+	pos = -1
+	for b, delims := range inlinePgpBlocks {
+		for from := 0; ; {
+			i := bytes.Index(text[from:], []byte(delims.begin))
+			if i == -1 {
+				break
+			}
+			i += from
+			if i == 0 || text[i-1] == '\n' {
+				if pos == -1 || i < pos {
+					pos, block = i, b
+				}
+				break
+			}
+			from = i + 1
+		}
+	}
+	return pos, block
+}
+
+// readInlinePgp replaces inline PGP encrypted or signed blocks in text by their
+// decrypted content. The content is enclosed in marker lines, as the
+// signatures only apply to it and not to the text around it.
+func (m *Mail) readInlinePgp(text []byte) []byte {
+	var out bytes.Buffer
+	found := false
+	unprotected := func(text []byte) {
+		if len(bytes.TrimSpace(text)) > 0 {
+			m.Security.Partial = true
+		}
+		out.Write(text)
+	}
+	for {
+		start, b := findInlinePgp(text)
+		if start == -1 {
+			break
+		}
+		delims := inlinePgpBlocks[b]
+		end := bytes.Index(text[start:], []byte(delims.end))
+		if end == -1 {
+			break
+		}
+		end += start + len(delims.end)
+
+		unprotected(text[:start])
+		found = true
+		kind, failure := "signed", "verification failed: "
+		if delims.encrypted {
+			m.Security.Encrypted = true
+			kind, failure = "encrypted", "decryption failed: "
+		}
+		plain, sigs, err := pgpDecrypt(text[start:end])
+		if err != nil {
+			m.Security.Errors = append(m.Security.Errors, failure+err.Error())
+			out.Write(text[start:end])
+		} else {
+			m.Security.Signatures = append(m.Security.Signatures, sigs...)
+			plain = convertToUtf8(plain)
+			if len(plain) > 0 && plain[len(plain)-1] != '\n' {
+				plain = append(plain, '\n')
+			}
+			out.WriteString("[-- Begin of PGP " + kind + " text --]\n")
+			out.Write(plain)
+			out.WriteString("[-- End of PGP " + kind + " text --]")
+		}
+		text = text[end:]
+	}
+	if found {
+		unprotected(text)
+	} else {
+		out.Write(text)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncodeSigned(t *testing.T) {
+	defer setupGnupgHome(t, "Alice <alice@example.com>")()
+
+	encoded, err := testMail().encodeSigned("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/signed" ||
+		params["protocol"] != "application/pgp-signature" || params["micalg"] == "" {
+		t.Fatalf("wrong content type %q", msg.Header.Get("Content-Type"))
+	}
+
+	// the signed part has to be verifiable byte by byte
+	parts := strings.Split(encoded, "\r\n--"+params["boundary"])
+	if len(parts) != 4 {
+		t.Fatalf("expected 2 parts, got %d", len(parts)-2)
+	}
+	content := strings.TrimPrefix(parts[1], "\r\n")
+	sig := parts[2][strings.Index(parts[2], "\r\n\r\n")+4:]
+
+	dir, _ := ioutil.TempDir("", "barely-test")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "content"), []byte(content), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "sig"), []byte(sig), 0600)
+	out, err := exec.Command("gpg", "--batch", "--verify", filepath.Join(dir, "sig"),
+		filepath.Join(dir, "content")).CombinedOutput()
+	if err != nil {
+		t.Fatal(string(out))
+	}
+}
+
+func TestEncodeEncrypted(t *testing.T) {
+	defer setupGnupgHome(t, "Alice <alice@example.com>", "Bob <bob@example.com>")()
+
+	account := &Account{Addr: "alice@example.com"}
+	encoded, err := testMail().encodeEncrypted(account, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/encrypted" ||
+		params["protocol"] != "application/pgp-encrypted" {
+		t.Fatalf("wrong content type %q", msg.Header.Get("Content-Type"))
+	}
+
+	start := strings.Index(encoded, "-----BEGIN PGP MESSAGE-----")
+	end := strings.Index(encoded, "-----END PGP MESSAGE-----")
+	if start == -1 || end == -1 {
+		t.Fatal("no PGP message found")
+	}
+	cmd := exec.Command("gpg", "--batch", "--decrypt")
+	cmd.Stdin = strings.NewReader(encoded[start : end+len("-----END PGP MESSAGE-----")])
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "Content-Type: text/plain") ||
+		!strings.Contains(string(out), "Hello Bob") {
+		t.Errorf("decrypted to %q", out)
+	}
+
+	// Bcc recipients can decrypt, but are not named in the message
+	m := testMail()
+	m.Header["To"] = []string{"alice@example.com"}
+	m.Header["Bcc"] = []string{"Bob <bob@example.com>"}
+	encoded, err = m.encodeEncrypted(account, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = strings.Index(encoded, "-----BEGIN PGP MESSAGE-----")
+	end = strings.Index(encoded, "-----END PGP MESSAGE-----")
+	cmd = exec.Command("gpg", "--batch", "--list-packets")
+	cmd.Stdin = strings.NewReader(encoded[start : end+len("-----END PGP MESSAGE-----")])
+	out, _ = cmd.Output()
+	if strings.Count(string(out), "keyid 0000000000000000") != 1 {
+		t.Errorf("expected one hidden recipient, got packets %s", out)
+	}
+
+	m = testMail()
+	m.Header["Cc"] = []string{"carol@example.com, Dave <dave@example.com>"}
+	_, err = m.encodeEncrypted(account, false)
+	if err == nil || !strings.Contains(err.Error(), "carol@example.com, dave@example.com") {
+		t.Errorf("expected missing keys error, got %v", err)
+	}
+}
+
+func TestReadPgp(t *testing.T) {
+	defer setupGnupgHome(t, "Alice <alice@example.com>", "Bob <bob@example.com>")()
+
+	signed, err := testMail().encodeSigned("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &Account{Addr: "alice@example.com"}
+	encrypted, err := testMail().encodeEncrypted(account, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearsign := exec.Command("gpg", "--batch", "--clearsign", "--local-user", "alice@example.com")
+	clearsign.Stdin = strings.NewReader("Hello Bob,\nthis is signed. äöü\n")
+	inline, err := clearsign.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		encoded   string
+		encrypted bool
+		status    SignatureStatus
+	}{
+		{"signed", signed, false, SigGood},
+		{"tampered", strings.Replace(signed, "Hello", "Hallo", 1), false, SigBad},
+		{"encrypted", encrypted, true, SigGood},
+		{"inline", "From: alice@example.com\r\nSubject: test\r\n\r\n" + string(inline), false, SigGood},
+	}
+	for _, test := range tests {
+		m := readEncoded(t, test.encoded)
+		if m.Security.Encrypted != test.encrypted {
+			t.Errorf("%s: encrypted is %v", test.name, m.Security.Encrypted)
+		}
+		if len(m.Security.Signatures) != 1 {
+			t.Errorf("%s: got signatures %v", test.name, m.Security.Signatures)
+			continue
+		}
+		sig := m.Security.Signatures[0]
+		if sig.Status != test.status || !strings.Contains(sig.Signer, "alice@example.com") {
+			t.Errorf("%s: got signature %v", test.name, sig)
+		}
+		if len(m.Parts) != 1 || !strings.Contains(m.Parts[0].Body, "this is signed. äöü") {
+			t.Errorf("%s: got parts %v", test.name, m.Parts)
+		}
+	}
+
+	// modified ciphertext must not be shown, even if gpg prints some of it
+	cmd := exec.Command("gpg", "--batch", "--encrypt", "--sign", "--local-user", "alice@example.com",
+		"--recipient", "bob@example.com")
+	cmd.Stdin = strings.NewReader(strings.Repeat("Hello Bob, this is signed.\n", 1000))
+	ciphertext, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext[len(ciphertext)-30] ^= 0xff
+	if plain, _, err := pgpDecrypt(ciphertext); err == nil || plain != nil {
+		t.Errorf("decrypted modified message to %d bytes without error", len(plain))
+	}
+
+	// signatures only cover their own block and have to match the sender
+	m := readEncoded(t, "From: alice@example.com\r\n\r\nUnsigned text\n"+string(inline))
+	if !m.Security.Partial || !m.Security.Bad() ||
+		!strings.Contains(m.Parts[0].Body, "Unsigned text\n[-- Begin of PGP signed text --]\nHello Bob") {
+		t.Errorf("got security %v, body %q", m.Security, m.Parts[0].Body)
+	}
+	m = readEncoded(t, "From: bob@example.com\r\n\r\n"+string(inline))
+	if len(m.Security.Signatures) != 1 || m.Security.Signatures[0].Status != SigWrongSender {
+		t.Errorf("got signatures %v for wrong sender", m.Security.Signatures)
+	}
+
+	// a key that is known but not certified
+	carolHome := newGnupgHome(t, "Carol <carol@example.com>")
+	carolSigned := gpg(t, carolHome, "Hello Bob\n", "--clearsign")
+	gpg(t, os.Getenv("GNUPGHOME"), string(gpg(t, carolHome, "", "--armor", "--export")), "--import")
+	m = readEncoded(t, "From: carol@example.com\r\n\r\n"+string(carolSigned))
+	if len(m.Security.Signatures) != 1 || m.Security.Signatures[0].Status != SigUntrusted {
+		t.Errorf("got signatures %v for untrusted key", m.Security.Signatures)
+	}
+
+	// without the key of the signer
+	os.Setenv("GNUPGHOME", t.TempDir())
+	m = readEncoded(t, signed)
+	if len(m.Security.Signatures) != 1 || m.Security.Signatures[0].Status != SigUnknownKey {
+		t.Errorf("got signatures %v without key", m.Security.Signatures)
+	}
+}
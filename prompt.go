@@ -22,7 +22,7 @@ type completionContext struct {
 func (cc *completionContext) query(str []rune) (result []rune) {
 	sstr := string(str)
 
-	// Don’t do file path completion if the command is not yet finished.
+	// Don’t do path or address completion if the command is not yet finished.
 	if strings.LastIndex(sstr, " ") == -1 {
 		return str
 	}
@@ -37,7 +37,11 @@ func (cc *completionContext) query(str []rune) (result []rune) {
 	}
 
 	cc.matchIdx = 0
-	cc.matches = completion.Query(sstr)
+	if fields := strings.Fields(sstr); len(fields) > 0 && addressCommands[fields[0]] {
+		cc.matches = completion.QueryAddress(sstr, currentAddressBook())
+	} else {
+		cc.matches = completion.Query(sstr)
+	}
 
 	if cc.matches == nil {
 		return str
@@ -0,0 +1,104 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	termbox "github.com/nsf/termbox-go"
+)
+
+// A question is displayed at the bottom of the screen and lets the user choose
+// one of several answers by pressing a key. While a question is active, all key
+// events go to the question.
+type question struct {
+	text    string
+	answers map[rune]func()
+	cancel  func() // executed when escape is pressed. May be nil.
+}
+
+// ask displays a question. Pressing one of the keys in answers executes the
+// corresponding function. Escape executes cancel.
+func (b *BufferStack) ask(text string, answers map[rune]func(), cancel func()) {
+	b.question = &question{text, answers, cancel}
+	b.refresh()
+}
+
+// handleQuestionEvent handles key events while a question is active.
+func (b *BufferStack) handleQuestionEvent(event *termbox.Event) {
+	q := b.question
+	if event.Ch == 0 && event.Key == termbox.KeyEsc {
+		b.question = nil
+		if q.cancel != nil {
+			q.cancel()
+		}
+	} else if answer, ok := q.answers[event.Ch]; ok {
+		b.question = nil
+		answer()
+	} else {
+		return
+	}
+	b.refresh()
+}
+
+// closeBuffer closes buf. If buf contains mail that was neither sent nor saved,
+// the user is asked what to do with it first and closeBuffer returns false.
+// If the stack is quitting, quitting continues after the question is answered.
+func (b *BufferStack) closeBuffer(buf Buffer) bool {
+	cb, ok := buf.(*ComposeBuffer)
+	if !ok || !cb.unsaved() {
+		b.remove(buf)
+		if !b.quitting {
+			b.refresh()
+		}
+		return true
+	}
+
+	// focus the buffer in question
+	b.detach(buf)
+	b.buffers = append(b.buffers, buf)
+
+	cont := func() {
+		if b.quitting {
+			b.quit()
+		}
+	}
+	b.ask("Mail not sent! (s)end, save (d)raft, discard (x), (c)ancel",
+		map[rune]func(){
+			's': func() {
+				cb.closeAfterSend = true
+				cb.HandleCommand("send", nil, b)
+			},
+			'd': func() {
+				err := cb.saveDraft()
+				if err != nil {
+					StatusLine = err.Error()
+					b.quitting = false
+					return
+				}
+				b.remove(cb)
+				cont()
+			},
+			'x': func() {
+				cb.discarded = true
+				b.remove(cb)
+				cont()
+			},
+			'c': func() {
+				b.quitting = false
+			},
+		}, func() {
+			b.quitting = false
+		})
+	return false
+}
+
+// quit closes all buffers, asking about unsent mail first.
+func (b *BufferStack) quit() {
+	b.quitting = true
+	for len(b.buffers) > 0 {
+		if !b.closeBuffer(b.buffers[len(b.buffers)-1]) {
+			return
+		}
+	}
+}
@@ -6,9 +6,9 @@ package main
 
 import (
 	"errors"
-	"log"
-	"time"
-	"unicode/utf8"
+	"fmt"
+	"regexp"
+	"strings"
 
 	"github.com/laochailan/notmuch-go"
 	termbox "github.com/nsf/termbox-go"
@@ -26,6 +26,7 @@ type result interface {
 	GetSubject() string
 	GetDate() int64
 	GetAuthor() string
+	GetHeader(name string) string
 	GetTags() *notmuch.Tags
 }
 
@@ -49,6 +50,15 @@ func (t *threadResult) GetAuthor() string {
 	return t.GetAuthors()
 }
 
+// GetHeader returns a header of the first message in the thread.
+func (t *threadResult) GetHeader(name string) string {
+	msgs := t.GetToplevelMessages()
+	if msgs == nil || !msgs.Valid() {
+		return ""
+	}
+	return msgs.Get().GetHeader(name)
+}
+
 type messageResults struct {
 	*notmuch.Messages
 }
@@ -79,15 +89,26 @@ func (m *messageResult) GetSubject() string {
 type SearchBuffer struct {
 	term string // Search term
 	typ  SearchType
+	sort SortOrder
 
 	database *notmuch.Database
 	messages []result
 	msgit    results
 	query    *notmuch.Query
 
-	cursor int
+	cursor   int
+	total    int // number of results of the query, counted by countAsync
+	counted  int // databaseVersion the count was started at
+	counting int // incremented for each count so that outdated ones are ignored
+
+	// marked results, identified by their query string (see resultQuery).
+	marked map[string]bool
 }
 
+// tagAllConfirmCount is the number of messages the tagall and untagall
+// commands change without asking.
+const tagAllConfirmCount = 100
+
 // SearchType is the type of the objects searched for.
 type SearchType int
 
@@ -103,11 +124,14 @@ func NewSearchBuffer(term string, typ SearchType) *SearchBuffer {
 	buf := new(SearchBuffer)
 	buf.term = term
 	buf.typ = typ
+	buf.sort = getSortOrder(term)
+	buf.marked = make(map[string]bool)
+	buf.counted = -1
 
 	buf.database, status = notmuch.OpenDatabase(expandEnvHome(config.General.Database), 0)
 	if status != notmuch.STATUS_SUCCESS {
 		StatusLine = status.String()
-		log.Fatalln("Could not open notmuch database: ", status.String())
+		fatal("Could not open notmuch database:", status.String())
 	}
 
 	buf.refreshQuery()
@@ -143,10 +167,42 @@ func tagString(msg result) (strs []string, fgs []int) {
 	return strs, fgs
 }
 
+// drawResultLine draws a single search result in line y. prefix is drawn in front of
+// the author, e.g. to indent replies in a thread. If hl is true, the line is highlighted
+// as the cursor line. Marked results get a marker in the first column.
+func drawResultLine(y int, msg result, prefix string, hl, marked bool) {
+	w, _ := termbox.Size()
+	cbuf := termbox.CellBuffer()
+
+	for x := 0; x < w; x++ {
+		cbuf[y*w+x].Ch = 0
+		if hl {
+			cbuf[y*w+x].Fg = termbox.Attribute(config.Theme.HlFg) |
+				termbox.AttrBold
+			cbuf[y*w+x].Bg = termbox.Attribute(config.Theme.HlBg)
+		} else {
+			cbuf[y*w+x].Fg = 0
+			cbuf[y*w+x].Bg = 0
+		}
+	}
+
+	if msg == nil {
+		return
+	}
+
+	if marked {
+		markFg := config.Theme.Mark | int(termbox.AttrBold)
+		if hl {
+			markFg = -1
+		}
+		printLine(0, y, "*", markFg, -1)
+	}
+	config.General.Search_Format.Draw(1, y, msg, prefix, hl)
+}
+
 // Draw draws the content of the buffer.
 func (b *SearchBuffer) Draw() {
-	w, h := termbox.Size()
-	cbuf := termbox.CellBuffer()
+	_, h := termbox.Size()
 
 	offset := 0
 	if b.cursor >= h*3/4 {
@@ -160,52 +216,13 @@ func (b *SearchBuffer) Draw() {
 		}
 	}
 	for i := 0; i < h-2; i++ {
-		for x := 0; x < w; x++ {
-			cbuf[i*w+x].Ch = 0
-			if i+offset == b.cursor {
-				cbuf[i*w+x].Fg = termbox.Attribute(config.Theme.HlFg) |
-					termbox.AttrBold
-				cbuf[i*w+x].Bg = termbox.Attribute(config.Theme.HlBg)
-			} else {
-				cbuf[i*w+x].Fg = 0
-				cbuf[i*w+x].Bg = 0
-			}
-		}
-
-		if i+offset < 0 || i+offset >= len(b.messages) {
-			continue
-		}
-
-		t := b.messages[i+offset].GetDate()
-		date := shortTime(time.Unix(t, 0))
-		from := shortFrom(b.messages[i+offset].GetAuthor())
-		subj := b.messages[i+offset].GetSubject()
-
-		tags, tagFgs := tagString(b.messages[i+offset])
-
-		dateFg := config.Theme.Date
-		fromFg := config.Theme.From
-		subjFg := config.Theme.Subject
-
-		// Do not color line if we are under the cursor
-		if i+offset == b.cursor {
-			dateFg = -1
-			fromFg = -1
-			subjFg = -1
-		}
-		printLine(1, i, date, dateFg, -1)
-
-		tagLength := 0
-		for j := range tags {
-			if i+offset == b.cursor {
-				tagFgs[j] = -1
-			}
-			printLine(10+tagLength, i, tags[j], tagFgs[j], -1)
-			tagLength += utf8.RuneCountInString(tags[j]) + 1
+		var msg result
+		marked := false
+		if i+offset >= 0 && i+offset < len(b.messages) {
+			msg = b.messages[i+offset]
+			marked = b.marked[resultQuery(msg)]
 		}
-		printLine(11+tagLength-1, i, from, fromFg, -1)
-		printLine(12+len(from)+tagLength, i, subj, subjFg, -1)
-
+		drawResultLine(i, msg, "", i+offset == b.cursor, marked)
 	}
 }
 
@@ -215,7 +232,14 @@ func (b *SearchBuffer) Title() string {
 	if b.typ == STMessages {
 		msg = "messages "
 	}
-	return msg + "for \"" + b.term + "\""
+	return msg + "for \"" + b.term + "\" (" + b.sort.String() + ")"
+}
+
+// Position returns the cursor position and the total number of results.
+func (b *SearchBuffer) Position() (int, int) {
+	// the count may still be running
+	total := max(b.total, len(b.messages))
+	return min(b.cursor+1, total), total
 }
 
 // Name returns the name of the buffer.
@@ -229,62 +253,205 @@ func (b *SearchBuffer) Close() {
 	b.database.Close()
 }
 
-// tagCmd is used to manipulate tags of the message.
+// idQuery returns a notmuch query string matching the message with the given id.
+// The id is quoted as it may contain spaces or parentheses.
+func idQuery(id string) string {
+	return "id:\"" + strings.Replace(id, "\"", "\"\"", -1) + "\""
+}
+
+// resultQuery returns a notmuch query string matching exactly the result r.
+func resultQuery(r result) string {
+	switch r := r.(type) {
+	case *messageResult:
+		return idQuery(r.GetMessageId())
+	case *threadResult:
+		return "thread:" + r.GetThreadId()
+	}
+	return ""
+}
+
+// loadAll loads all remaining results of the query.
+func (b *SearchBuffer) loadAll() {
+	for b.msgit != nil && b.msgit.Valid() {
+		b.messages = append(b.messages, b.msgit.Get())
+		b.msgit.MoveToNext()
+	}
+}
+
+// selection returns the query strings of the results commands should operate on.
+// These are the marked results if there are any, otherwise the result under the cursor.
+func (b *SearchBuffer) selection() ([]string, error) {
+	if len(b.marked) > 0 {
+		queries := make([]string, 0, len(b.marked))
+		for q := range b.marked {
+			queries = append(queries, q)
+		}
+		return queries, nil
+	}
+	if b.cursor < 0 || b.cursor >= len(b.messages) {
+		return nil, errors.New("No messages selected")
+	}
+	return []string{resultQuery(b.messages[b.cursor])}, nil
+}
+
+// markCmd changes the set of marked results.
+func (b *SearchBuffer) markCmd(cmd string, args []string) error {
+	switch cmd {
+	case "mark":
+		if b.cursor < 0 || b.cursor >= len(b.messages) {
+			return errors.New("Nothing to mark")
+		}
+		q := resultQuery(b.messages[b.cursor])
+		if b.marked[q] {
+			delete(b.marked, q)
+		} else {
+			b.marked[q] = true
+		}
+	case "markall":
+		b.loadAll()
+		for _, msg := range b.messages {
+			b.marked[resultQuery(msg)] = true
+		}
+	case "unmarkall":
+		b.marked = make(map[string]bool)
+	case "invertmarks":
+		b.loadAll()
+		for _, msg := range b.messages {
+			q := resultQuery(msg)
+			if b.marked[q] {
+				delete(b.marked, q)
+			} else {
+				b.marked[q] = true
+			}
+		}
+	case "markpattern":
+		if len(args) == 0 {
+			return errors.New("No pattern given")
+		}
+		re, err := regexp.Compile(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		b.loadAll()
+		for _, msg := range b.messages {
+			if re.MatchString(msg.GetAuthor()) || re.MatchString(msg.GetSubject()) {
+				b.marked[resultQuery(msg)] = true
+			}
+		}
+	}
+	return nil
+}
+
+// tagCmd is used to manipulate tags of the selected messages. The changes are
+// recorded in the undo history of stack.
 // cmd can be either "tag" or "untag"
-func (b *SearchBuffer) tagCmd(cmd string, tags []string) error {
+func (b *SearchBuffer) tagCmd(cmd string, tags []string, stack *BufferStack) error {
 	if len(b.messages) == 0 {
 		return errors.New("No messages to tag")
 	}
-	db, status := notmuch.OpenDatabase(expandEnvHome(config.General.Database), 1)
+
+	queries, err := b.selection()
+	if err != nil {
+		return err
+	}
+
+	changes, err := tagQueries(cmd, queries, tags)
+	stack.recordTagChanges(changes)
+	if err == nil {
+		b.marked = make(map[string]bool)
+	}
+	return err
+}
+
+// tagQuery adds or removes tags of all messages matching queryStr and returns the
+// changes actually made, one entry per changed message. All changes are done in a
+// single atomic transaction.
+// cmd can be either "tag" or "untag"
+func tagQuery(cmd, queryStr string, tags []string) ([]tagChange, error) {
+	return tagQueries(cmd, []string{queryStr}, tags)
+}
+
+// tagQueries works like tagQuery for the messages matching any of queryStrs.
+// Each query is run on its own so that they do not form one huge query.
+func tagQueries(cmd string, queryStrs []string, tags []string) (changes []tagChange, err error) {
+	db, status := openWritable()
 	if status != notmuch.STATUS_SUCCESS {
-		return errors.New(status.String())
+		return nil, errors.New(status.String())
 	}
-	defer db.Close()
+	defer closeWritable(db)
 
-	queryStr := ""
-	if b.typ == STMessages {
-		queryStr = "id:" + b.messages[b.cursor].(*messageResult).GetMessageId()
-	} else {
-		queryStr = "thread:" + b.messages[b.cursor].(*threadResult).GetThreadId()
+	status = db.BeginAtomic()
+	if status != notmuch.STATUS_SUCCESS {
+		return nil, errors.New(status.String())
 	}
+	defer func() {
+		status := db.EndAtomic()
+		if status != notmuch.STATUS_SUCCESS && err == nil {
+			err = errors.New(status.String())
+		}
+	}()
 
+	for _, queryStr := range queryStrs {
+		changes, err = tagMessages(db, cmd, queryStr, tags, changes)
+		if err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+// tagMessages tags the messages matching queryStr in db and appends the changes
+// made to changes.
+func tagMessages(db *notmuch.Database, cmd, queryStr string, tags []string,
+	changes []tagChange) ([]tagChange, error) {
 	query := db.CreateQuery(queryStr)
+	defer query.Destroy()
 	msgit := query.SearchMessages()
 	if msgit == nil {
-		return errors.New("Message not found")
+		return changes, errors.New("Message not found")
 	}
 
+	var status notmuch.Status
 	for msgit.Valid() {
 		msg := msgit.Get()
+		change := tagChange{id: msg.GetMessageId()}
 		msg.Freeze()
 
 		for _, tag := range tags {
 			switch cmd {
 			case "tag":
+				if !hasTag(msg, tag) {
+					change.added = append(change.added, tag)
+				}
 				status = msg.AddTag(tag)
 			case "untag":
+				if hasTag(msg, tag) {
+					change.removed = append(change.removed, tag)
+				}
 				status = msg.RemoveTag(tag)
 			}
 
 			if status != 0 {
-				return errors.New(status.String())
+				return changes, errors.New(status.String())
 			}
 		}
 		status = msg.Thaw()
 		if status != 0 {
-			return errors.New(status.String())
+			return changes, errors.New(status.String())
 		}
 		if config.General.Synchronize_Flags {
 			status = msg.TagsToMaildirFlags()
 			if status != 0 {
-				return errors.New(status.String())
+				return changes, errors.New(status.String())
 			}
 		}
+		if len(change.added) > 0 || len(change.removed) > 0 {
+			changes = append(changes, change)
+		}
 		msgit.MoveToNext()
 	}
-	query.Destroy()
 
-	return nil
+	return changes, nil
 }
 
 // refreshQuery reopens the database connection and refreshes the search.
@@ -303,7 +470,11 @@ func (b *SearchBuffer) refreshQuery() {
 	_, h := termbox.Size()
 	b.messages = make([]result, 0, h)
 	b.query = b.database.CreateQuery(b.term)
+	b.query.SetSort(notmuch.Sort(b.sort))
 
+	if b.counted != databaseVersion() {
+		b.countAsync()
+	}
 	if b.typ == STMessages {
 		it := b.query.SearchMessages()
 		if it == nil {
@@ -335,6 +506,66 @@ func (b *SearchBuffer) refreshQuery() {
 	}
 }
 
+// countAsync counts the results of the search in the background with its own
+// database connection, as counting threads has to look at every matching message.
+// The count is kept until the database changes.
+func (b *SearchBuffer) countAsync() {
+	b.counted = databaseVersion()
+	b.counting++
+	counting, term, typ := b.counting, b.term, b.typ
+	var count int
+	runAsync(func() error {
+		db, status := notmuch.OpenDatabase(expandEnvHome(config.General.Database), 0)
+		if status != notmuch.STATUS_SUCCESS {
+			return errors.New(status.String())
+		}
+		defer db.Close()
+		query := db.CreateQuery(term)
+		defer query.Destroy()
+		if typ == STMessages {
+			count = int(query.CountMessages())
+		} else {
+			count = int(query.CountThreads())
+		}
+		return nil
+	}, func(stack *BufferStack, err error) {
+		if counting != b.counting || err != nil {
+			return
+		}
+		b.total = count
+		stack.drawBottomBar()
+	})
+}
+
+// refreshKeepCursor refreshes the search and keeps the cursor on the same result
+// if it is still part of the results.
+func (b *SearchBuffer) refreshKeepCursor() {
+	key := ""
+	if b.cursor >= 0 && b.cursor < len(b.messages) {
+		key = resultQuery(b.messages[b.cursor])
+	}
+	b.refreshQuery()
+	if key == "" || b.msgit == nil {
+		return
+	}
+
+	// only look a page further to avoid loading huge searches.
+	_, h := termbox.Size()
+	for i := 0; i < b.cursor+h; i++ {
+		if i >= len(b.messages) {
+			if !b.msgit.Valid() {
+				break
+			}
+			b.messages = append(b.messages, b.msgit.Get())
+			b.msgit.MoveToNext()
+		}
+		if resultQuery(b.messages[i]) == key {
+			b.cursor = i
+			break
+		}
+	}
+}
+
 // HandleCommand handles buffer local commands.
 func (b *SearchBuffer) HandleCommand(cmd string, args []string, stack *BufferStack) bool {
 	switch cmd {
@@ -362,24 +593,96 @@ func (b *SearchBuffer) HandleCommand(cmd string, args []string, stack *BufferSta
 			b.Draw()
 		}
 	case "show":
-		if b.typ == STThreads { // open a list of messages in the thread instead
-			threadid := b.messages[b.cursor].(*threadResult).GetThreadId()
-			stack.Push(NewSearchBuffer("thread:"+threadid, STMessages))
+		if len(b.marked) > 0 { // list all messages of the selection
+			queries, _ := b.selection()
+			stack.Push(NewSearchBuffer(strings.Join(queries, " or "), STMessages))
+			break
+		}
+		if b.typ == STThreads { // open the thread as a tree of messages instead
+			if b.cursor >= 0 && b.cursor < len(b.messages) {
+				threadid := b.messages[b.cursor].(*threadResult).GetThreadId()
+				stack.Push(NewThreadBuffer(threadid))
+			}
 			break
 		} else if b.typ == STMessages {
 			if b.cursor >= 0 && b.cursor < len(b.messages) {
 				stack.Push(NewMailBuffer(b.messages[b.cursor].(*messageResult).GetFileName()))
 			}
 		}
+	case "resume":
+		if b.typ != STMessages || b.cursor < 0 || b.cursor >= len(b.messages) {
+			StatusLine = "No draft selected"
+			break
+		}
+		stack.Push(NewComposeBufferFromDraft(b.messages[b.cursor].(*messageResult).GetFileName()))
+	case "conversation":
+		if b.cursor < 0 || b.cursor >= len(b.messages) {
+			break
+		}
+		threadid := ""
+		if b.typ == STThreads {
+			threadid = b.messages[b.cursor].(*threadResult).GetThreadId()
+		} else {
+			threadid = b.messages[b.cursor].(*messageResult).GetThreadId()
+		}
+		stack.Push(NewConversationBuffer(threadid))
+	case "mark", "markall", "unmarkall", "invertmarks", "markpattern":
+		err := b.markCmd(cmd, args)
+		if err != nil {
+			StatusLine = err.Error()
+		} else {
+			StatusLine = fmt.Sprintf("%d marked", len(b.marked))
+		}
+		b.Draw()
 	case "tag", "untag":
-		err := b.tagCmd(cmd, args)
+		err := b.tagCmd(cmd, args, stack)
 		if err != nil {
 			StatusLine = err.Error()
 		}
 		b.refreshQuery()
 		b.Draw()
-	case "_refresh":
+	case "sort":
+		if len(args) == 0 {
+			StatusLine = "sorted " + b.sort.String()
+			break
+		}
+		err := b.sort.UnmarshalText([]byte(args[0]))
+		if err != nil {
+			StatusLine = err.Error()
+			break
+		}
+		b.cursor = 0
 		b.refreshQuery()
+		stack.refresh()
+	case "tagall", "untagall":
+		if len(args) == 0 {
+			StatusLine = "No tags given"
+			break
+		}
+		tagcmd := strings.TrimSuffix(cmd, "all")
+		tagAll := func() {
+			changes, err := tagQuery(tagcmd, b.term, args)
+			stack.recordTagChanges(changes)
+			if err != nil {
+				StatusLine = err.Error()
+			} else {
+				StatusLine = fmt.Sprintf("%sged %d messages", tagcmd, len(changes))
+			}
+			b.refreshQuery()
+		}
+
+		query := b.database.CreateQuery(b.term)
+		count := int(query.CountMessages())
+		query.Destroy()
+		if count <= tagAllConfirmCount {
+			tagAll()
+			b.Draw()
+			break
+		}
+		stack.ask(fmt.Sprintf("%s all %d messages? (y)es, (n)o", tagcmd, count),
+			map[rune]func(){'y': tagAll, 'n': func() {}}, nil)
+	case "_refresh":
+		b.refreshKeepCursor()
 	default:
 		return false
 	}
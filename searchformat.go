@@ -0,0 +1,214 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// formatField is a single element of a SearchFormat. It is either a field
+// like %date or a piece of literal text.
+type formatField struct {
+	name    string // field name, empty for literal text
+	literal string
+
+	width int  // 0 means the natural width of the content
+	right bool // align right inside width
+}
+
+// SearchFormat describes the layout of a line in search buffers. It is
+// written as a string like "%date:8 %authors:20 %tags %subject" where
+// %name:N pads or truncates a field to N columns and %name:>N additionally
+// aligns it to the right.
+type SearchFormat []formatField
+
+// searchFields are the valid names of fields in a SearchFormat.
+var searchFields = map[string]bool{
+	"date":    true, // short date of the message or newest message of the thread
+	"authors": true, // first word of the author(s)
+	"from":    true, // full author(s)
+	"to":      true, // recipients
+	"list":    true, // mailing list from the List-Id header
+	"tags":    true,
+	"subject": true,
+	"count":   true, // matched/total messages of a thread
+	"tree":    true, // reply tree connectors in thread buffers
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaller interface.
+func (f *SearchFormat) UnmarshalText(text []byte) error {
+	str := []rune(string(text))
+	*f = (*f)[:0]
+	literal := ""
+
+	for i := 0; i < len(str); i++ {
+		if str[i] != '%' {
+			literal += string(str[i])
+			continue
+		}
+		if i+1 < len(str) && str[i+1] == '%' {
+			literal += "%"
+			i++
+			continue
+		}
+
+		if literal != "" {
+			*f = append(*f, formatField{literal: literal})
+			literal = ""
+		}
+
+		j := i + 1
+		for j < len(str) && unicode.IsLetter(str[j]) {
+			j++
+		}
+		field := formatField{name: string(str[i+1 : j])}
+		if !searchFields[field.name] {
+			return fmt.Errorf("Unknown field '%%%s' in search format.", field.name)
+		}
+
+		if j < len(str) && str[j] == ':' {
+			j++
+			if j < len(str) && str[j] == '>' {
+				field.right = true
+				j++
+			}
+			k := j
+			for k < len(str) && unicode.IsDigit(str[k]) {
+				k++
+			}
+			var err error
+			field.width, err = strconv.Atoi(string(str[j:k]))
+			if err != nil {
+				return fmt.Errorf("Invalid width for field '%%%s' in search format.", field.name)
+			}
+			j = k
+		}
+		*f = append(*f, field)
+		i = j - 1
+	}
+	if literal != "" {
+		*f = append(*f, formatField{literal: literal})
+	}
+	return nil
+}
+
+// segment is a piece of text printed in a single color.
+type segment struct {
+	text string
+	fg   int
+}
+
+// listName returns the mailing list identifier out of a List-Id header.
+func listName(listid string) string {
+	if start := strings.LastIndex(listid, "<"); start != -1 {
+		listid = listid[start+1:]
+		if end := strings.Index(listid, ">"); end != -1 {
+			listid = listid[:end]
+		}
+	}
+	return strings.TrimSpace(listid)
+}
+
+// fieldSegments returns the colored content of a field for msg.
+func fieldSegments(name string, msg result, prefix string) []segment {
+	switch name {
+	case "date":
+		return []segment{{shortTime(time.Unix(msg.GetDate(), 0)), config.Theme.Date}}
+	case "authors":
+		return []segment{{shortFrom(msg.GetAuthor()), config.Theme.From}}
+	case "from":
+		return []segment{{msg.GetAuthor(), config.Theme.From}}
+	case "to":
+		return []segment{{msg.GetHeader("To"), config.Theme.From}}
+	case "list":
+		return []segment{{listName(msg.GetHeader("List-Id")), config.Theme.Tags}}
+	case "subject":
+		return []segment{{msg.GetSubject(), config.Theme.Subject}}
+	case "tree":
+		return []segment{{prefix, config.Theme.Tags}}
+	case "count":
+		// show how many messages of a thread matched the search
+		if t, ok := msg.(*threadResult); ok {
+			return []segment{{fmt.Sprintf("(%d/%d)", t.GetMatchedMessages(),
+				t.GetTotalMessages()), config.Theme.Tags}}
+		}
+	case "tags":
+		tags, tagFgs := tagString(msg)
+		segs := make([]segment, 0, len(tags))
+		for i := range tags {
+			text := tags[i]
+			if i < len(tags)-1 {
+				text += " "
+			}
+			segs = append(segs, segment{text, tagFgs[i]})
+		}
+		return segs
+	}
+	return nil
+}
+
+// fitSegments truncates or pads segments to the given width.
+func fitSegments(segs []segment, width int, right bool) []segment {
+	fitted := make([]segment, 0, len(segs)+1)
+	used := 0
+	for _, s := range segs {
+		if used >= width {
+			break
+		}
+		s.text = truncateWidth(s.text, width-used)
+		used += stringWidth(s.text)
+		fitted = append(fitted, s)
+	}
+
+	pad := segment{strings.Repeat(" ", width-used), -1}
+	if right {
+		return append([]segment{pad}, fitted...)
+	}
+	return append(fitted, pad)
+}
+
+// Draw prints msg in line y according to the format, starting at column x.
+// If hl is true, the configured colors are not used.
+func (f SearchFormat) Draw(x, y int, msg result, prefix string, hl bool) {
+	skipSpace := false
+	for _, field := range f {
+		if field.name == "" {
+			text := field.literal
+			if skipSpace && strings.HasPrefix(text, " ") {
+				text = text[1:]
+			}
+			printLine(x, y, text, -1, -1)
+			x += stringWidth(text)
+			skipSpace = false
+			continue
+		}
+
+		segs := fieldSegments(field.name, msg, prefix)
+		empty := true
+		for _, s := range segs {
+			if s.text != "" {
+				empty = false
+			}
+		}
+		// do not leave double spaces for empty fields of natural width
+		skipSpace = empty && field.width == 0
+
+		if field.width > 0 {
+			segs = fitSegments(segs, field.width, field.right)
+		}
+		for _, s := range segs {
+			fg := s.fg
+			if hl {
+				fg = -1
+			}
+			printLine(x, y, s.text, fg, -1)
+			x += stringWidth(s.text)
+		}
+	}
+}
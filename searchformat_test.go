@@ -0,0 +1,44 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchFormat(t *testing.T) {
+	var f SearchFormat
+	err := f.UnmarshalText([]byte("%date:8 %authors:>20 100%% %subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SearchFormat{
+		{name: "date", width: 8},
+		{literal: " "},
+		{name: "authors", width: 20, right: true},
+		{literal: " 100% "},
+		{name: "subject"},
+	}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("parsed %v", f)
+	}
+
+	if f.UnmarshalText([]byte("%date %nonsense")) == nil {
+		t.Error("accepted unknown field")
+	}
+	if f.UnmarshalText([]byte("%date:x")) == nil {
+		t.Error("accepted invalid width")
+	}
+}
+
+func TestListName(t *testing.T) {
+	if n := listName("Notmuch mail <notmuch.notmuchmail.org>"); n != "notmuch.notmuchmail.org" {
+		t.Errorf("got %q", n)
+	}
+	if n := listName("plain.example.com"); n != "plain.example.com" {
+		t.Errorf("got %q", n)
+	}
+}
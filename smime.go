@@ -0,0 +1,402 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// opensslCommand creates a command running the configured openssl program
+// with args.
+func opensslCommand(args ...string) *exec.Cmd {
+	strcmd := strings.Split(config.Commands.Openssl, " ")
+	return exec.Command(strcmd[0], append(strcmd[1:], args...)...)
+}
+
+// runOpenssl runs openssl with args and input on stdin and returns its output.
+// The error contains the reason openssl gives for failing.
+func runOpenssl(input []byte, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := opensslCommand(args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil {
+		return stdout.Bytes(), nil
+	}
+
+	// error lines look like "<code>:error:<number>:<lib>:<func>:<reason>:..."
+	msg := strings.TrimSpace(stderr.String())
+	for _, line := range strings.Split(msg, "\n") {
+		if i := strings.Index(line, "Verify error:"); i != -1 {
+			return nil, errors.New(line[i+len("Verify error:"):])
+		}
+	}
+	if msg == "" {
+		return nil, errors.New("openssl: " + err.Error())
+	}
+	return nil, errors.New("openssl: " + strings.Split(msg, "\n")[0])
+}
+
+// writeTempFile writes data to a new temporary file and returns its name.
+func writeTempFile(data []byte) (string, error) {
+	file, err := ioutil.TempFile("", "barely-smime")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// readCertificate reads the first certificate in the PEM file filename.
+func readCertificate(filename string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No certificate in " + filename)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// smimeSigner returns a signature with the given status made with the first
+// certificate in the PEM file filename. The signer is the name and first
+// address of the certificate.
+func smimeSigner(status SignatureStatus, filename, detail string) Signature {
+	sig := Signature{Status: status, Detail: detail}
+	cert, err := readCertificate(filename)
+	if err != nil {
+		return sig
+	}
+	sig.Signer = cert.Subject.CommonName
+	if len(cert.EmailAddresses) > 0 {
+		sig.Signer += " <" + cert.EmailAddresses[0] + ">"
+	}
+	sig.Signer = strings.TrimSpace(sig.Signer)
+	sig.addrs = cert.EmailAddresses
+	return sig
+}
+
+// smimeVerify checks the signature of a DER encoded CMS structure. content
+// is the signed content for detached signatures and nil otherwise. It returns
+// the content of non-detached signatures.
+func smimeVerify(cms, content []byte) ([]byte, Signature) {
+	signerFile, err := writeTempFile(nil)
+	if err != nil {
+		return nil, Signature{Status: SigError, Detail: err.Error()}
+	}
+	defer os.Remove(signerFile)
+
+	args := []string{"cms", "-verify", "-binary", "-inform", "DER", "-signer", signerFile}
+	if content != nil {
+		contentFile, err := writeTempFile(content)
+		if err != nil {
+			return nil, Signature{Status: SigError, Detail: err.Error()}
+		}
+		defer os.Remove(contentFile)
+		args = append(args, "-content", contentFile)
+	}
+
+	verifyArgs := args
+	if config.General.Smime_Ca_File != "" {
+		verifyArgs = append(verifyArgs, "-CAfile", expandEnvHome(config.General.Smime_Ca_File))
+	}
+	out, err := runOpenssl(cms, verifyArgs...)
+	if err == nil {
+		return out, smimeSigner(SigGood, signerFile, "")
+	}
+
+	// find out whether the signature or the certificate is the problem
+	out, noverifyErr := runOpenssl(cms, append(args, "-noverify")...)
+	if noverifyErr == nil {
+		return out, smimeSigner(SigUnknownKey, signerFile, err.Error())
+	}
+	return nil, Signature{Status: SigBad, Detail: err.Error()}
+}
+
+// cmsRecipient identifies the certificate of a recipient of a CMS structure,
+// either by issuer and serial number or by subject key identifier.
+type cmsRecipient struct {
+	issuer []byte // DER encoded issuer name
+	serial *big.Int
+	keyID  []byte
+}
+
+// matches returns true if r identifies cert.
+func (r *cmsRecipient) matches(cert *x509.Certificate) bool {
+	if r.keyID != nil {
+		return bytes.Equal(r.keyID, cert.SubjectKeyId)
+	}
+	return bytes.Equal(r.issuer, cert.RawIssuer) && r.serial.Cmp(cert.SerialNumber) == 0
+}
+
+// asn1Elements splits DER encoded data into its elements.
+func asn1Elements(data []byte) ([]asn1.RawValue, error) {
+	var elements []asn1.RawValue
+	for len(data) > 0 {
+		var element asn1.RawValue
+		var err error
+		data, err = asn1.Unmarshal(data, &element)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
+
+// parseRecipientID parses the recipient identifier of a key transport or
+// key agreement recipient (RFC 5652). Both are an IssuerAndSerialNumber or
+// a subject key identifier tagged [0].
+func parseRecipientID(rid asn1.RawValue) (*cmsRecipient, error) {
+	if rid.Class == asn1.ClassContextSpecific && rid.Tag == 0 {
+		if !rid.IsCompound {
+			return &cmsRecipient{keyID: rid.Bytes}, nil
+		}
+		// RecipientKeyIdentifier starting with the subject key identifier
+		var keyID []byte
+		_, err := asn1.Unmarshal(rid.Bytes, &keyID)
+		return &cmsRecipient{keyID: keyID}, err
+	}
+	var ias struct {
+		Issuer asn1.RawValue
+		Serial *big.Int
+	}
+	if _, err := asn1.Unmarshal(rid.FullBytes, &ias); err != nil {
+		return nil, err
+	}
+	return &cmsRecipient{issuer: ias.Issuer.FullBytes, serial: ias.Serial}, nil
+}
+
+// cmsRecipients returns the recipients a DER encoded CMS enveloped-data or
+// authenveloped-data structure is encrypted for. Recipients of other kinds
+// than key transport (RSA) and key agreement (EC) are left out.
+func cmsRecipients(cms []byte) ([]*cmsRecipient, error) {
+	errInvalid := errors.New("Invalid S/MIME message.")
+
+	// ContentInfo is the content type followed by the content tagged [0].
+	info, err := asn1Elements(cms)
+	if err != nil {
+		return nil, err
+	}
+	if len(info) != 1 {
+		return nil, errInvalid
+	}
+	info, err = asn1Elements(info[0].Bytes)
+	if err != nil || len(info) != 2 {
+		return nil, errInvalid
+	}
+	content, err := asn1Elements(info[1].Bytes)
+	if err != nil || len(content) != 1 {
+		return nil, errInvalid
+	}
+	fields, err := asn1Elements(content[0].Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// recipientInfos is the only SET, following the optional originatorInfo.
+	var recipients []*cmsRecipient
+	for _, field := range fields {
+		if field.Class != asn1.ClassUniversal || field.Tag != asn1.TagSet {
+			continue
+		}
+		infos, err := asn1Elements(field.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		for _, ri := range infos {
+			elements, err := asn1Elements(ri.Bytes)
+			if err != nil || len(elements) < 2 {
+				return nil, errInvalid
+			}
+			var rids []asn1.RawValue
+			switch {
+			case ri.Class == asn1.ClassUniversal && ri.Tag == asn1.TagSequence:
+				// KeyTransRecipientInfo: version, rid, ...
+				rids = append(rids, elements[1])
+			case ri.Class == asn1.ClassContextSpecific && ri.Tag == 1:
+				// KeyAgreeRecipientInfo ends with the encrypted keys, each
+				// starting with a rid.
+				keys, err := asn1Elements(elements[len(elements)-1].Bytes)
+				if err != nil {
+					return nil, err
+				}
+				for _, key := range keys {
+					keyElements, err := asn1Elements(key.Bytes)
+					if err != nil || len(keyElements) == 0 {
+						return nil, errInvalid
+					}
+					rids = append(rids, keyElements[0])
+				}
+			}
+			for _, rid := range rids {
+				recipient, err := parseRecipientID(rid)
+				if err != nil {
+					return nil, err
+				}
+				recipients = append(recipients, recipient)
+			}
+		}
+		return recipients, nil
+	}
+	return nil, errInvalid
+}
+
+// smimeDecrypt decrypts a DER encoded CMS enveloped-data structure with the
+// certificate and key of the account it is encrypted for.
+func smimeDecrypt(cms []byte) ([]byte, error) {
+	recipients, err := cmsRecipients(cms)
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range config.Account {
+		if account.Smime_Cert == "" || account.Smime_Key == "" {
+			continue
+		}
+		cert, err := readCertificate(expandEnvHome(account.Smime_Cert))
+		if err != nil {
+			continue
+		}
+		for _, recipient := range recipients {
+			if recipient.matches(cert) {
+				return runOpenssl(cms, "cms", "-decrypt", "-binary", "-inform", "DER",
+					"-recip", expandEnvHome(account.Smime_Cert),
+					"-inkey", expandEnvHome(account.Smime_Key))
+			}
+		}
+	}
+	return nil, errors.New("Not encrypted for the smime-cert of any account.")
+}
+
+// readDecoded reads body, removing the content transfer encoding.
+func readDecoded(header textproto.MIMEHeader, body io.Reader) ([]byte, error) {
+	if header.Get("Content-Transfer-Encoding") == "base64" {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	return ioutil.ReadAll(body)
+}
+
+// readSmimeSigned reads a multipart/signed body with an S/MIME signature
+// (RFC 5751), verifies it and reads the signed content.
+func (m *Mail) readSmimeSigned(body io.Reader, boundary string) error {
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	parts := splitMultipart(raw, boundary)
+	if len(parts) != 2 {
+		return m.readParts(bytes.NewReader(raw), boundary)
+	}
+
+	sigHeader, sigReader, err := parseEntity(parts[1])
+	if err != nil {
+		return err
+	}
+	sig, err := readDecoded(sigHeader, sigReader)
+	if err != nil {
+		return err
+	}
+	_, status := smimeVerify(sig, []byte(canonicalCRLF(string(parts[0]))))
+	m.Security.Signatures = append(m.Security.Signatures, status)
+
+	header, content, err := parseEntity(parts[0])
+	if err != nil {
+		return err
+	}
+	return m.readPart(header, content)
+}
+
+// readSmime reads an application/pkcs7-mime part. Signed data is verified and
+// enveloped data decrypted. If that fails, the part is kept as attachment.
+func (m *Mail) readSmime(header textproto.MIMEHeader, body io.Reader) error {
+	_, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	data, err := readDecoded(header, body)
+	if err != nil {
+		return err
+	}
+
+	var content []byte
+	switch strings.ToLower(params["smime-type"]) {
+	case "signed-data":
+		var sig Signature
+		content, sig = smimeVerify(data, nil)
+		m.Security.Signatures = append(m.Security.Signatures, sig)
+	case "enveloped-data", "authenveloped-data":
+		m.Security.Encrypted = true
+		content, err = smimeDecrypt(data)
+		if err != nil {
+			m.Security.Errors = append(m.Security.Errors, "decryption failed: "+err.Error())
+		}
+	}
+
+	if content == nil {
+		m.Parts = append(m.Parts, Part{header, string(data)})
+		return nil
+	}
+
+	innerHeader, inner, err := parseEntity(content)
+	if err != nil {
+		return err
+	}
+	return m.readPart(innerHeader, inner)
+}
+
+// smimeSign creates a DER encoded detached S/MIME signature of content with
+// the certificate and key of account.
+func smimeSign(content []byte, account *Account) ([]byte, error) {
+	if account.Smime_Cert == "" || account.Smime_Key == "" {
+		return nil, errors.New("No smime-cert and smime-key configured for account.")
+	}
+	return runOpenssl(content, "cms", "-sign", "-binary", "-outform", "DER", "-md", "sha256",
+		"-signer", expandEnvHome(account.Smime_Cert),
+		"-inkey", expandEnvHome(account.Smime_Key))
+}
+
+// encodeSmimeSigned encodes the mail as S/MIME signed message (RFC 5751)
+// signed with the certificate of account.
+func (m *Mail) encodeSmimeSigned(account *Account) (string, error) {
+	content, err := m.encodeEntity()
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := smimeSign([]byte(content), account)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := encodeBase64(bytes.NewReader(sig))
+	if err != nil {
+		return "", err
+	}
+
+	return m.encodeMultipartSigned(content, "application/pkcs7-signature", "sha-256",
+		"Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n"+
+			"Content-Transfer-Encoding: base64\r\n"+
+			"Content-Disposition: attachment; filename=\"smime.p7s\"\r\n"+
+			"Content-Description: S/MIME Cryptographic Signature\r\n",
+		canonicalCRLF(encoded)), nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSmime(t *testing.T) {
+	account, restore := setupSmime(t)
+	defer restore()
+
+	signed, err := testMail().encodeSmimeSigned(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// opaque signed and encrypted mail as created by other clients
+	entity, err := testMail().encodeEntity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opaque, err := runOpenssl([]byte(entity), "cms", "-sign", "-nodetach", "-binary",
+		"-outform", "DER", "-signer", account.Smime_Cert, "-inkey", account.Smime_Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enveloped, err := runOpenssl([]byte(entity), "cms", "-encrypt", "-binary",
+		"-outform", "DER", "-aes256", account.Smime_Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelopedKeyID, err := runOpenssl([]byte(entity), "cms", "-encrypt", "-binary", "-keyid",
+		"-outform", "DER", "-aes256", account.Smime_Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs7Mail := func(smimeType string, data []byte) string {
+		encoded, err := encodeBase64(strings.NewReader(string(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "From: alice@example.com\r\nMIME-Version: 1.0\r\n" +
+			"Content-Type: application/pkcs7-mime; smime-type=" + smimeType + "; name=smime.p7m\r\n" +
+			"Content-Transfer-Encoding: base64\r\n\r\n" + encoded
+	}
+
+	tests := []struct {
+		name      string
+		encoded   string
+		caFile    string
+		encrypted bool
+		status    SignatureStatus
+	}{
+		{"signed", signed, config.General.Smime_Ca_File, false, SigGood},
+		{"untrusted", signed, "", false, SigUnknownKey},
+		{"tampered", strings.Replace(signed, "Hello", "Hallo", 1), config.General.Smime_Ca_File, false, SigBad},
+		{"opaque", pkcs7Mail("signed-data", opaque), config.General.Smime_Ca_File, false, SigGood},
+		{"enveloped", pkcs7Mail("enveloped-data", enveloped), config.General.Smime_Ca_File, true, -1},
+		{"key id", pkcs7Mail("enveloped-data", envelopedKeyID), config.General.Smime_Ca_File, true, -1},
+	}
+	for _, test := range tests {
+		config.General.Smime_Ca_File = test.caFile
+		m := readEncoded(t, test.encoded)
+		if m.Security.Encrypted != test.encrypted || len(m.Security.Errors) != 0 {
+			t.Errorf("%s: got security %v", test.name, m.Security)
+		}
+		if test.status == -1 {
+			if len(m.Security.Signatures) != 0 {
+				t.Errorf("%s: got signatures %v", test.name, m.Security.Signatures)
+			}
+		} else if len(m.Security.Signatures) != 1 || m.Security.Signatures[0].Status != test.status {
+			t.Errorf("%s: got signatures %v", test.name, m.Security.Signatures)
+		} else if test.status != SigBad && m.Security.Signatures[0].Signer != "Alice <alice@example.com>" {
+			t.Errorf("%s: got signer %q", test.name, m.Security.Signatures[0].Signer)
+		}
+		if test.status != SigBad && (len(m.Parts) != 1 ||
+			!strings.Contains(m.Parts[0].Body, "this is signed. äöü")) {
+			t.Errorf("%s: got parts %v", test.name, m.Parts)
+		}
+	}
+
+	// mail for someone else is not tried with the key of any account
+	forCA, err := runOpenssl([]byte(entity), "cms", "-encrypt", "-binary",
+		"-outform", "DER", "-aes256", config.General.Smime_Ca_File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := readEncoded(t, pkcs7Mail("enveloped-data", forCA))
+	if len(m.Security.Errors) != 1 || !strings.Contains(m.Security.Errors[0], "Not encrypted for") {
+		t.Errorf("got security %v for mail to someone else", m.Security)
+	}
+}
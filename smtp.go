@@ -0,0 +1,187 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smtpTimeout is the time a complete SMTP session may take.
+const smtpTimeout = 2 * time.Minute
+
+// loginAuth implements the LOGIN authentication mechanism, which is not
+// supported by net/smtp but still required by some servers.
+type loginAuth struct {
+	username, password string
+}
+
+// Start implements the smtp.Auth interface.
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// like smtp.PlainAuth, do not send the password without encryption
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next implements the smtp.Auth interface.
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	challenge := strings.ToLower(string(fromServer))
+	switch {
+	case strings.HasPrefix(challenge, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(challenge, "pass"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
+
+// smtpPassword runs the smtp-password-command of account and returns the first
+// line of its output.
+func smtpPassword(account *Account) (string, error) {
+	if account.Smtp_Password_Command == "" {
+		return "", errors.New("No smtp-password-command configured for account.")
+	}
+	strcmd := strings.Split(account.Smtp_Password_Command, " ")
+	output, err := exec.Command(strcmd[0], strcmd[1:]...).Output()
+	if err != nil {
+		return "", fmt.Errorf("smtp-password-command failed: %s", err)
+	}
+	return strings.TrimRight(strings.SplitN(string(output), "\n", 2)[0], "\r"), nil
+}
+
+// smtpAuth chooses the authentication mechanism for client c. Without smtp-auth
+// in the account, PLAIN is used if the server supports it and LOGIN otherwise.
+func smtpAuth(c *smtp.Client, account *Account, host, password string) (smtp.Auth, error) {
+	mechanism := strings.ToLower(account.Smtp_Auth)
+	if mechanism == "" {
+		mechanism = "login"
+		if ok, mechanisms := c.Extension("AUTH"); ok {
+			for _, m := range strings.Fields(mechanisms) {
+				if strings.EqualFold(m, "PLAIN") {
+					mechanism = "plain"
+				}
+			}
+		}
+	}
+
+	switch mechanism {
+	case "plain":
+		return smtp.PlainAuth("", account.Smtp_User, password, host), nil
+	case "login":
+		return &loginAuth{account.Smtp_User, password}, nil
+	}
+	return nil, fmt.Errorf("Invalid smtp-auth '%s'.", account.Smtp_Auth)
+}
+
+// smtpSend submits the mail content to the SMTP server of account. The
+// envelope sender is the address of the account.
+func smtpSend(account *Account, recipients []string, content string) error {
+	security := strings.ToLower(account.Smtp_Security)
+	if security == "" {
+		security = "starttls"
+	}
+	port := account.Smtp_Port
+	if port == 0 {
+		port = 587
+		if security == "tls" {
+			port = 465
+		}
+	}
+	host := account.Smtp_Host
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: host}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	switch security {
+	case "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	case "starttls", "none":
+		conn, err = dialer.Dial("tcp", addr)
+	default:
+		return fmt.Errorf("Invalid smtp-security '%s'.", account.Smtp_Security)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	if err = c.Hello(hostname); err != nil {
+		return err
+	}
+
+	if security == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP server does not support STARTTLS.")
+		}
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if account.Smtp_User != "" {
+		password, err := smtpPassword(account)
+		if err != nil {
+			return err
+		}
+		auth, err := smtpAuth(c, account, host, password)
+		if err != nil {
+			return err
+		}
+		if err = c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(account.Addr); err != nil {
+		return err
+	}
+	for _, r := range recipients {
+		if err = c.Rcpt(r); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write([]byte(content)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	// The mail was accepted, so an error now must not lead to sending it again.
+	if err = c.Quit(); err != nil {
+		log.Println("SMTP QUIT failed after the mail was sent: " + err.Error())
+	}
+	return nil
+}
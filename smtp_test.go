@@ -0,0 +1,158 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// smtpSession records what a client sent to the stand-in SMTP server.
+type smtpSession struct {
+	auth       []string // decoded authentication data
+	from       string
+	recipients []string
+	data       string
+}
+
+// startSmtpServer starts a minimal SMTP server on localhost that accepts a
+// single session. It offers the given AUTH mechanisms. The session is sent to
+// the returned channel when the client quits. If hangUp is true, the server
+// closes the connection instead of answering QUIT.
+func startSmtpServer(t *testing.T, mechanisms string, hangUp bool) (port int, sessions chan smtpSession) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions = make(chan smtpSession, 1)
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c := textproto.NewConn(conn)
+		defer c.Close()
+
+		decode := func(str string) string {
+			dec, _ := base64.StdEncoding.DecodeString(str)
+			return string(dec)
+		}
+		var s smtpSession
+		c.PrintfLine("220 localhost ESMTP test")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch {
+			case cmd == "EHLO":
+				c.PrintfLine("250-localhost")
+				if mechanisms != "" {
+					c.PrintfLine("250-AUTH " + mechanisms)
+				}
+				c.PrintfLine("250 8BITMIME")
+			case strings.HasPrefix(line, "AUTH PLAIN "):
+				s.auth = append(s.auth, decode(strings.TrimPrefix(line, "AUTH PLAIN ")))
+				c.PrintfLine("235 ok")
+			case line == "AUTH LOGIN":
+				c.PrintfLine("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				user, _ := c.ReadLine()
+				c.PrintfLine("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				pass, _ := c.ReadLine()
+				s.auth = append(s.auth, decode(user), decode(pass))
+				c.PrintfLine("235 ok")
+			case cmd == "MAIL":
+				s.from = line
+				c.PrintfLine("250 ok")
+			case cmd == "RCPT":
+				s.recipients = append(s.recipients, line)
+				c.PrintfLine("250 ok")
+			case cmd == "DATA":
+				c.PrintfLine("354 go ahead")
+				data, _ := c.ReadDotBytes()
+				s.data = string(data)
+				c.PrintfLine("250 queued")
+			case cmd == "QUIT":
+				if !hangUp {
+					c.PrintfLine("221 bye")
+				}
+				sessions <- s
+				return
+			default:
+				c.PrintfLine("502 unknown command")
+			}
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, sessions
+}
+
+func TestSmtpSend(t *testing.T) {
+	content := "From: me@example.com\r\nTo: bob@example.com\r\n\r\nHello\r\n"
+	recipients := []string{"bob@example.com", "hidden@example.com"}
+
+	tests := []struct {
+		mechanisms string
+		auth       string
+		expected   []string
+	}{
+		{"LOGIN PLAIN", "", []string{"\x00me\x00secret"}},
+		{"LOGIN", "", []string{"me", "secret"}},
+		{"LOGIN PLAIN", "login", []string{"me", "secret"}},
+	}
+	for _, test := range tests {
+		port, sessions := startSmtpServer(t, test.mechanisms, false)
+		account := &Account{
+			Addr:                  "me@example.com",
+			Smtp_Host:             "127.0.0.1",
+			Smtp_Port:             port,
+			Smtp_Security:         "none",
+			Smtp_User:             "me",
+			Smtp_Auth:             test.auth,
+			Smtp_Password_Command: "echo secret",
+		}
+		err := smtpSend(account, recipients, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := <-sessions
+		if !reflect.DeepEqual(s.auth, test.expected) {
+			t.Errorf("%s: got authentication %q", test.mechanisms, s.auth)
+		}
+		if s.from != "MAIL FROM:<me@example.com>" && !strings.HasPrefix(s.from, "MAIL FROM:<me@example.com> ") {
+			t.Errorf("got %q", s.from)
+		}
+		if !reflect.DeepEqual(s.recipients, []string{"RCPT TO:<bob@example.com>", "RCPT TO:<hidden@example.com>"}) {
+			t.Errorf("got recipients %q", s.recipients)
+		}
+		if s.data != strings.Replace(content, "\r\n", "\n", -1) {
+			t.Errorf("got data %q", s.data)
+		}
+	}
+
+	// once the data is accepted, the mail is sent even if QUIT fails
+	port, sessions := startSmtpServer(t, "", true)
+	account := &Account{Addr: "me@example.com", Smtp_Host: "127.0.0.1", Smtp_Port: port, Smtp_Security: "none"}
+	if err := smtpSend(account, recipients, content); err != nil {
+		t.Error(err)
+	}
+	if s := <-sessions; s.data == "" {
+		t.Error("no data sent")
+	}
+
+	// STARTTLS is required by default
+	port, _ = startSmtpServer(t, "", false)
+	account = &Account{Addr: "me@example.com", Smtp_Host: "127.0.0.1", Smtp_Port: port}
+	if err := smtpSend(account, recipients, content); err == nil {
+		t.Error("sent without STARTTLS")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/laochailan/notmuch-go"
+	termbox "github.com/nsf/termbox-go"
+)
+
+// ThreadBuffer displays the messages of a thread as a tree showing
+// which message replies to which.
+type ThreadBuffer struct {
+	threadid string
+
+	database *notmuch.Database
+	query    *notmuch.Query
+
+	messages []*messageResult
+	prefixes []string // tree connectors drawn in front of each message
+
+	cursor int
+}
+
+// NewThreadBuffer creates a new ThreadBuffer for the thread with id threadid.
+func NewThreadBuffer(threadid string) *ThreadBuffer {
+	buf := new(ThreadBuffer)
+	buf.threadid = threadid
+
+	err := buf.refreshThread()
+	if err != nil {
+		StatusLine = err.Error()
+	}
+	return buf
+}
+
+// walkThread calls fn for every message of a notmuch message tree in depth-first
+// order. The prefix passed to fn contains the tree connectors for that message.
+// indent is the prefix inherited from the parent messages.
+func walkThread(msgs *notmuch.Messages, indent string, toplevel bool, fn func(msg *notmuch.Message, prefix string)) {
+	if msgs == nil {
+		return
+	}
+
+	// collect the siblings first to know which one is the last.
+	var siblings []*notmuch.Message
+	for msgs.Valid() {
+		siblings = append(siblings, msgs.Get())
+		msgs.MoveToNext()
+	}
+
+	for i, msg := range siblings {
+		last := i == len(siblings)-1
+		prefix, childIndent := "", ""
+		switch {
+		case toplevel:
+		case last:
+			prefix, childIndent = indent+"└─", indent+"  "
+		default:
+			prefix, childIndent = indent+"├─", indent+"│ "
+		}
+
+		fn(msg, prefix)
+		walkThread(msg.GetReplies(), childIndent, false, fn)
+	}
+}
+
+// refreshThread reopens the database connection and rebuilds the message tree.
+func (b *ThreadBuffer) refreshThread() error {
+	var status notmuch.Status
+	if b.query != nil {
+		b.query.Destroy()
+		b.query = nil
+	}
+	if b.database != nil {
+		b.database.Close()
+	}
+	b.messages = b.messages[:0]
+	b.prefixes = b.prefixes[:0]
+
+	b.database, status = notmuch.OpenDatabase(expandEnvHome(config.General.Database), 0)
+	if status != notmuch.STATUS_SUCCESS {
+		b.database = nil
+		return errors.New(status.String())
+	}
+
+	b.query = b.database.CreateQuery("thread:" + b.threadid)
+	threads := b.query.SearchThreads()
+	if threads == nil || !threads.Valid() {
+		return errors.New("Thread not found")
+	}
+	walkThread(threads.Get().GetToplevelMessages(), "", true,
+		func(msg *notmuch.Message, prefix string) {
+			b.messages = append(b.messages, &messageResult{msg})
+			b.prefixes = append(b.prefixes, prefix)
+		})
+
+	if b.cursor >= len(b.messages) {
+		b.cursor = max(0, len(b.messages)-1)
+	}
+	return nil
+}
+
+// Draw draws the content of the buffer.
+func (b *ThreadBuffer) Draw() {
+	_, h := termbox.Size()
+
+	offset := 0
+	if b.cursor >= h*3/4 {
+		offset = -h*3/4 + b.cursor
+	}
+
+	for i := 0; i < h-2; i++ {
+		if i+offset < 0 || i+offset >= len(b.messages) {
+			drawResultLine(i, nil, "", false, false)
+			continue
+		}
+		drawResultLine(i, b.messages[i+offset], b.prefixes[i+offset], i+offset == b.cursor, false)
+	}
+}
+
+// Title returns the title string of the buffer.
+func (b *ThreadBuffer) Title() string {
+	return "thread:" + b.threadid
+}
+
+// Position returns the cursor position and the number of messages in the thread.
+func (b *ThreadBuffer) Position() (int, int) {
+	return min(b.cursor+1, len(b.messages)), len(b.messages)
+}
+
+// Name returns the name of the buffer.
+func (b *ThreadBuffer) Name() string {
+	return "thread"
+}
+
+// Close closes the buffer.
+func (b *ThreadBuffer) Close() {
+	if b.query != nil {
+		b.query.Destroy()
+	}
+	if b.database != nil {
+		b.database.Close()
+	}
+}
+
+// HandleCommand handles buffer local commands.
+func (b *ThreadBuffer) HandleCommand(cmd string, args []string, stack *BufferStack) bool {
+	switch cmd {
+	case "move":
+		if len(args) == 0 {
+			break
+		}
+		_, h := termbox.Size()
+		switch args[0] {
+		case "up":
+			b.cursor--
+		case "down":
+			b.cursor++
+		case "pageup":
+			b.cursor -= h
+		case "pagedown":
+			b.cursor += h
+		}
+		if b.cursor >= len(b.messages) {
+			b.cursor = len(b.messages) - 1
+		}
+		if b.cursor < 0 {
+			b.cursor = 0
+		}
+		b.Draw()
+	case "show":
+		if b.cursor >= 0 && b.cursor < len(b.messages) {
+			stack.Push(NewMailBuffer(b.messages[b.cursor].GetFileName()))
+		}
+	case "conversation":
+		stack.Push(NewConversationBuffer(b.threadid))
+	case "tag", "untag":
+		if b.cursor < 0 || b.cursor >= len(b.messages) {
+			StatusLine = "No messages to tag"
+			break
+		}
+		changes, err := tagQuery(cmd, idQuery(b.messages[b.cursor].GetMessageId()), args)
+		stack.recordTagChanges(changes)
+		if err != nil {
+			StatusLine = err.Error()
+		}
+		err = b.refreshThread()
+		if err != nil {
+			StatusLine = err.Error()
+		}
+		b.Draw()
+	case "_refresh":
+		err := b.refreshThread()
+		if err != nil {
+			StatusLine = err.Error()
+		}
+	default:
+		return false
+	}
+	return true
+}
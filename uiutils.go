@@ -39,12 +39,41 @@ func printLine(x, y int, text string, fg, bg int) {
 		if bg >= 0 {
 			cbuf[y*w+x+i].Bg = termbox.Attribute(bg)
 		}
-		runeWidth := runewidth.RuneWidth(c)
-		if runeWidth == 0 || (runeWidth == 2 && runewidth.IsAmbiguousWidth(c)) {
-			runeWidth = 1
+		i += runeCells(c)
+	}
+}
+
+// runeCells returns the number of cells printLine uses for the rune c.
+func runeCells(c rune) int {
+	if !strconv.IsPrint(c) {
+		return 0
+	}
+	runeWidth := runewidth.RuneWidth(c)
+	if runeWidth == 0 || (runeWidth == 2 && runewidth.IsAmbiguousWidth(c)) {
+		runeWidth = 1
+	}
+	return runeWidth
+}
+
+// stringWidth returns the number of cells printLine uses for str.
+func stringWidth(str string) int {
+	width := 0
+	for _, c := range str {
+		width += runeCells(c)
+	}
+	return width
+}
+
+// truncateWidth cuts str so that it fits into width cells.
+func truncateWidth(str string, width int) string {
+	used := 0
+	for i, c := range str {
+		if used+runeCells(c) > width {
+			return str[:i]
 		}
-		i += runeWidth
+		used += runeCells(c)
 	}
+	return str
 }
 
 func shortFrom(from string) string {
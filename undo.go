@@ -0,0 +1,121 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/laochailan/notmuch-go"
+)
+
+// tagChange records the tags that were actually added to and removed from a
+// single message.
+type tagChange struct {
+	id      string // message id
+	added   []string
+	removed []string
+}
+
+// applyTagChanges applies a list of tag changes to the database in a single
+// atomic transaction. If revert is true, the changes are undone instead.
+func applyTagChanges(changes []tagChange, revert bool) (err error) {
+	db, status := openWritable()
+	if status != notmuch.STATUS_SUCCESS {
+		return errors.New(status.String())
+	}
+	defer closeWritable(db)
+
+	status = db.BeginAtomic()
+	if status != notmuch.STATUS_SUCCESS {
+		return errors.New(status.String())
+	}
+	defer func() {
+		status := db.EndAtomic()
+		if status != notmuch.STATUS_SUCCESS && err == nil {
+			err = errors.New(status.String())
+		}
+	}()
+
+	for _, c := range changes {
+		add, remove := c.added, c.removed
+		if revert {
+			add, remove = remove, add
+		}
+
+		msg, status := db.FindMessage(c.id)
+		if status != notmuch.STATUS_SUCCESS {
+			return errors.New(status.String())
+		}
+		if msg == nil { // the message was removed from the database in the meantime
+			continue
+		}
+
+		msg.Freeze()
+		for _, tag := range add {
+			status = msg.AddTag(tag)
+			if status != notmuch.STATUS_SUCCESS {
+				msg.Destroy()
+				return errors.New(status.String())
+			}
+		}
+		for _, tag := range remove {
+			status = msg.RemoveTag(tag)
+			if status != notmuch.STATUS_SUCCESS {
+				msg.Destroy()
+				return errors.New(status.String())
+			}
+		}
+		status = msg.Thaw()
+		if status == notmuch.STATUS_SUCCESS && config.General.Synchronize_Flags {
+			status = msg.TagsToMaildirFlags()
+		}
+		msg.Destroy()
+		if status != notmuch.STATUS_SUCCESS {
+			return errors.New(status.String())
+		}
+	}
+	return nil
+}
+
+// recordTagChanges adds tag changes to the undo history. Recording a new change
+// clears the redo history.
+func (b *BufferStack) recordTagChanges(changes []tagChange) {
+	if len(changes) == 0 {
+		return
+	}
+	b.undoHistory = append(b.undoHistory, changes)
+	b.redoHistory = nil
+}
+
+// undoCmd reverts the last tag change in the undo history. If redo is true,
+// the last undone change is applied again instead.
+func (b *BufferStack) undoCmd(redo bool) error {
+	from, to := &b.undoHistory, &b.redoHistory
+	if redo {
+		from, to = to, from
+	}
+	if len(*from) == 0 {
+		if redo {
+			return errors.New("Nothing to redo")
+		}
+		return errors.New("Nothing to undo")
+	}
+
+	changes := (*from)[len(*from)-1]
+	err := applyTagChanges(changes, !redo)
+	if err != nil {
+		return err
+	}
+	*from = (*from)[:len(*from)-1]
+	*to = append(*to, changes)
+
+	if redo {
+		StatusLine = fmt.Sprintf("redid tag changes of %d messages", len(changes))
+	} else {
+		StatusLine = fmt.Sprintf("undid tag changes of %d messages", len(changes))
+	}
+	return nil
+}
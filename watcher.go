@@ -0,0 +1,108 @@
+// Copyright 2015 Lukas Weber. All rights reserved.
+// Use of this source code is governed by the MIT-styled
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/laochailan/notmuch-go"
+)
+
+// ownWrite is the modification time of the database after barely last wrote
+// to it. watchDatabase does not refresh for these changes.
+var ownWrite struct {
+	sync.Mutex
+	modTime time.Time
+}
+
+// databaseChanges counts the writes to the database noticed by barely. Data
+// cached from the database, like the number of results of a search, is
+// outdated when it changes.
+var databaseChanges struct {
+	sync.Mutex
+	n int
+}
+
+// databaseChanged records a write to the database.
+func databaseChanged() {
+	databaseChanges.Lock()
+	databaseChanges.n++
+	databaseChanges.Unlock()
+}
+
+// databaseVersion returns the number of writes to the database noticed so far.
+func databaseVersion() int {
+	databaseChanges.Lock()
+	defer databaseChanges.Unlock()
+	return databaseChanges.n
+}
+
+// openWritable opens the notmuch database for writing. It has to be closed
+// with closeWritable.
+func openWritable() (*notmuch.Database, notmuch.Status) {
+	return notmuch.OpenDatabase(expandEnvHome(config.General.Database), 1)
+}
+
+// closeWritable closes a database opened by openWritable and remembers the
+// resulting modification time as barely's own.
+func closeWritable(db *notmuch.Database) {
+	db.Close()
+	mtime := databaseModTime(expandEnvHome(config.General.Database))
+	ownWrite.Lock()
+	ownWrite.modTime = mtime
+	ownWrite.Unlock()
+	databaseChanged()
+}
+
+// refreshEvents requests a refresh of the current buffer. Requests made
+// while one is pending are merged into it.
+var refreshEvents = make(chan struct{}, 1)
+
+// databaseModTime returns the time of the last write to the Xapian database
+// notmuch keeps in path.
+func databaseModTime(path string) time.Time {
+	var latest time.Time
+	infos, err := ioutil.ReadDir(filepath.Join(path, ".notmuch", "xapian"))
+	if err != nil {
+		return latest
+	}
+	for _, info := range infos {
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// watchDatabase checks the notmuch database in path for changes every interval
+// and refreshes the current buffer if something else than barely wrote to it,
+// e.g. "notmuch new".
+//
+// watchDatabase does not return and should be run in its own goroutine.
+func watchDatabase(path string, interval time.Duration) {
+	last := databaseModTime(path)
+	for {
+		time.Sleep(interval)
+		mtime := databaseModTime(path)
+		if mtime.Equal(last) {
+			continue
+		}
+		last = mtime
+		ownWrite.Lock()
+		own := mtime.Equal(ownWrite.modTime)
+		ownWrite.Unlock()
+		if own {
+			continue
+		}
+		databaseChanged()
+		select {
+		case refreshEvents <- struct{}{}:
+		default:
+		}
+	}
+}